@@ -28,6 +28,8 @@ const (
 // 	[IPSET_CMD_HEADER-1]	= NLM_F_REQUEST,
 // 	[IPSET_CMD_TYPE-1]	= NLM_F_REQUEST,
 // 	[IPSET_CMD_PROTOCOL-1]	= NLM_F_REQUEST,
+// 	[IPSET_CMD_GET_BYNAME-1]	= NLM_F_REQUEST,
+// 	[IPSET_CMD_GET_BYINDEX-1]	= NLM_F_REQUEST,
 // };
 
 var IPSetCmdflags = []int{
@@ -44,7 +46,8 @@ var IPSetCmdflags = []int{
 	syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,                                             // IPSET_CMD_TEST-1
 	syscall.NLM_F_REQUEST,                                                                 // IPSET_CMD_HEADER-1
 	syscall.NLM_F_REQUEST,                                                                 // IPSET_CMD_TYPE-1
-	syscall.NLM_F_REQUEST,                                                                 // IPSET_CMD_PROTOCOL-1
+	syscall.NLM_F_REQUEST,                                                                 // IPSET_CMD_GET_BYNAME-1
+	syscall.NLM_F_REQUEST,                                                                 // IPSET_CMD_GET_BYINDEX-1
 }
 
 // /* Data options */
@@ -250,6 +253,19 @@ const (
 //	NFPROTO_NUMPROTO,
 //};
 
+// IPSET_ATTR_INITVAL and IPSET_ATTR_BUCKETSIZE reuse the unused IPSET_ATTR_GC and IPSET_ATTR_PROBES in newer kernels,
+// they are missing in ipset/ipset.h
+const (
+	IPSET_ATTR_INITVAL    = IPSET_ATTR_GC
+	IPSET_ATTR_BUCKETSIZE = IPSET_ATTR_PROBES
+)
+
+// IPSET_FLAG_IFACE_WILDCARD is added to enum ipset_cadt_flags by newer kernels, it is missing in ipset/ipset.h
+const (
+	IPSET_FLAG_BIT_IFACE_WILDCARD = 7
+	IPSET_FLAG_IFACE_WILDCARD     = (1 << IPSET_FLAG_BIT_IFACE_WILDCARD)
+)
+
 const (
 	NFPROTO_UNSPEC = 0
 	NFPROTO_IPV4   = 2
@@ -271,18 +287,47 @@ type IPSet struct {
 	// The default is inet, i.e IPv4. For the inet family one can add or delete multiple entries by specifying a range
 	// or a network of IPv4 addresses in the IP address part of the entry:
 	Family string
-	// HashSize specifies the hash table size of ipset.
+	// HashSize specifies the initial hash table size of hash type ipset. 0 means the kernel default 1024.
 	HashSize int
-	// MaxElem specifies the max element number of ipset.
+	// MaxElem specifies the max element number of hash type ipset. 0 means the kernel default 65536.
 	MaxElem int
-	// PortRange specifies the port range of bitmap:port type ipset.
+	// PortRange specifies the port range of bitmap:port type ipset in the form of port-port.
 	PortRange string
-	// Comment specifies the comment for this ipset
+	// Comment specifies the comment for this ipset. Kernel does not store comments of sets, so it is ignored.
+	//
+	// Deprecated: use WithComment to create the set with comments of entries.
 	Comment string
 	// SetRevison is the revision of SetType. Check revisions supported to a SetType by modinfo $SetModuleName,
 	// e.g. modinfo ip_set_hash_ip ip_set_hash_ipmark
 	// If unset, assigns a static revison defined in constant.go
 	SetRevison *uint8
+	// Timeout is the default timeout value in seconds of entries of a set created with timeout support.
+	Timeout *uint32
+	// IPRange specifies the IPv4 range of bitmap:ip and bitmap:ip,mac type ipset in the form of ip-ip or ip/cidr.
+	IPRange string
+	// Netmask stores network addresses of the prefix length instead of IP addresses in bitmap:ip, hash:ip and
+	// hash:net,net type ipset.
+	Netmask uint8
+	// Probes and Resize are the hash tuning options of hash type ipset of revisions before bucketsize support. Kernel
+	// ignores them.
+	Probes, Resize uint8
+	// BucketSize is the max number of entries in a hash bucket of hash type ipset of revisions with bucketsize support.
+	BucketSize uint8
+	// InitVal is the initial value of the hash function of hash type ipset of revisions with bucketsize support.
+	InitVal *uint32
+	// WithCounters creates the set with packet and byte counters of entries.
+	WithCounters bool
+	// WithComment creates the set with comments of entries.
+	WithComment bool
+	// WithSkbInfo creates the set with skbinfo of entries, which is used by the SET target with --map-set.
+	WithSkbInfo bool
+	// WithForceAdd creates the hash type set which evicts a random entry when adding an entry to a full set.
+	WithForceAdd bool
+	// Size is the max number of member sets of list:set type ipset. 0 means the kernel default 8.
+	Size uint32
+	// MarkMask is the mask applied to the marks of entries of hash:ip,mark type ipset. 0 means the kernel default
+	// 0xffffffff.
+	MarkMask uint32
 }
 
 // Entry represents a ipset entry.
@@ -291,10 +336,15 @@ type Entry struct {
 	IP string
 	// ip[/cidr]
 	CIDR *uint8
+	// IPTo is the last IP address of the range from IP to IPTo. Kernel adds or deletes all addresses of the range in
+	// one request, hash:net* sets store the range as the fewest networks covering it. Ranges are IPv4 only.
+	IPTo string
 	// Port is the entry's Port, with PortTo to form a port range. If PortTo is not 0, then Port represents PortFrom.
 	Port, PortTo uint16
 	// Proto is the entry's Protocol. see unix.IPPROTO_*.
 	Proto uint8
+	// Mark is the entry's packet mark of hash:ip,mark type ipset.
+	Mark uint32
 	// Net is the entry's IP network address.  Network address with zero prefix size can NOT
 	// be stored.
 	Net string
@@ -302,8 +352,40 @@ type Entry struct {
 	IP2 string
 	// ip2[/cidr2]
 	CIDR2 *uint8
-	// mac address
+	// IP2To is the last IP address of the range from IP2 to IP2To.
+	IP2To string
+	// mac address. It is optional for bitmap:ip,mac type ipset, kernel fills it with the source mac address of the
+	// first matched packet.
 	Mac net.HardwareAddr
+	// Iface is the entry's interface name of hash:net,iface type ipset.
+	Iface string
+	// PhysDev matches Iface against the bridge port instead of the bridge device.
+	PhysDev bool
+	// Wildcard matches Iface as a prefix of interface names.
+	Wildcard bool
+	// NoMatch marks the entry as an exception of hash:net* type ipset, packets matching it do not match the set
+	// even if they match other entries.
+	NoMatch bool
+	// Timeout is the timeout value in seconds of the entry of a set created with timeout support. nil means the
+	// default timeout of the set and 0 means permanent. Listed entries have the remaining seconds.
+	Timeout *uint32
+	// Packets and Bytes are the counters of the entry of a set created with counters. nil means 0 when adding.
+	Packets, Bytes *uint64
+	// Comment is the comment of the entry of a set created with comment, at most IPSET_MAX_COMMENT_SIZE bytes.
+	Comment string
+	// SkbMark and SkbMarkMask are the packet mark and mask set by the SET target for the entry of a set created with
+	// skbinfo. SkbMarkMask 0 means 0xffffffff if SkbMark is not 0.
+	SkbMark, SkbMarkMask uint32
+	// SkbPrio is the tc class major:minor as major<<16 | minor set by the SET target.
+	SkbPrio uint32
+	// SkbQueue is the hardware queue set by the SET target.
+	SkbQueue uint16
+	// Name is the member set name of list:set type ipset.
+	Name string
+	// NameRef is the member set name which Name is added, deleted or tested after, or before if Before is true.
+	NameRef string
+	// Before positions Name before NameRef instead of after it.
+	Before bool
 	// SetType is the type of ipset where the entry exists.
 	SetType SetType
 	//  [ timeout value ] [ packets value ] [ bytes value ] [ comment string ] [ skbmark value ] [ skbprio value ] [ skbqueue value ]
@@ -332,6 +414,51 @@ const (
 	ListSet        SetType = "list:set"
 )
 
+// setTypes are all the set types
+var setTypes = []SetType{
+	BitmapIP,
+	BitmapIPMac,
+	BitmapPort,
+	HashIP,
+	HashMac,
+	HashIPMac,
+	HashNet,
+	HashNetNet,
+	HashIPPort,
+	HashNetPort,
+	HashIPPortIP,
+	HashIPPortNet,
+	HashIPMark,
+	HashNetPortNet,
+	HashNetIface,
+	ListSet,
+}
+
+// Capabilities is the ipset protocol versions and set types supported by kernel.
+type Capabilities struct {
+	ProtocolMin, ProtocolMax uint8
+	SetTypes                 []SetTypeCapability
+}
+
+// SetTypeCapability is the revisions of a set type of a family supported by kernel.
+type SetTypeCapability struct {
+	SetType SetType
+	Family  string
+	// Supported is false if kernel doesn't support the set type of the family.
+	Supported                bool
+	RevisionMin, RevisionMax uint8
+}
+
+// Supports returns if kernel supports setType of family, family is inet or inet6.
+func (c *Capabilities) Supports(setType SetType, family string) bool {
+	for i := range c.SetTypes {
+		if c.SetTypes[i].SetType == setType && c.SetTypes[i].Family == family {
+			return c.SetTypes[i].Supported
+		}
+	}
+	return false
+}
+
 // struct nfgenmsg {
 // 	uint8_t nfgen_family;
 // 	uint8_t version;
@@ -359,7 +486,20 @@ func (m *nfgenmsg) Len() int {
 	return SizeofNFGenMsg
 }
 
+// SetIndex is the kernel index of a set, which is referred by the set match and SET target of iptables.
+type SetIndex struct {
+	Name   string
+	Index  uint16
+	Family string
+}
+
 type ListItem struct {
 	IPSet
 	Entries []Entry
+	// References is the number of kernel components referencing the set, e.g. iptables rules.
+	References uint32
+	// MemSize is the memory size of the set in bytes.
+	MemSize uint32
+	// Elements is the number of entries of the set. It is zero if the kernel doesn't report it.
+	Elements uint32
 }
@@ -1,10 +1,14 @@
 package ipset
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/chenchun/ipset/log"
 	"github.com/vishvananda/netlink/nl"
@@ -51,18 +55,23 @@ func (h *Handle) Create(set *IPSet, opts ...Opt) error {
 	}
 	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(set.Name)))
 	req.AddData(nl.NewRtAttr(IPSET_ATTR_TYPENAME, nl.ZeroTerminated(string(set.SetType))))
-	if err := h.fillRevision(req, set.SetType, set.SetRevison); err != nil {
+	revision, err := h.fillRevision(req, set.SetType, set.SetRevison)
+	if err != nil {
 		return err
 	}
 	fillFamily(req, set.Family)
+	if err := fillCreateData(req, set, revision); err != nil {
+		return err
+	}
+	fillExist(req, opts)
 	h.l.Debugf("create %v", req.Serialize())
 	_, err = req.Execute(unix.NETLINK_NETFILTER, 0)
 	return err
 }
 
 func (h *Handle) Destroy(setName string, opts ...Opt) error {
-	if setName == "" {
-		return fmt.Errorf("invalid destroy command: missing setname")
+	if err := checkSetName("destroy", setName); err != nil {
+		return err
 	}
 	req, err := h.newRequest(IPSET_CMD_DESTROY)
 	if err != nil {
@@ -73,7 +82,231 @@ func (h *Handle) Destroy(setName string, opts ...Opt) error {
 	return err
 }
 
-func (h *Handle) fillRevision(req *nl.NetlinkRequest, setType SetType, revision *uint8) error {
+// DestroyAll destroys all sets which are not referenced by kernel components.
+func (h *Handle) DestroyAll(opts ...Opt) error {
+	req, err := h.newRequest(IPSET_CMD_DESTROY)
+	if err != nil {
+		return err
+	}
+	// without IPSET_ATTR_SETNAME kernel destroys all sets
+	_, err = req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
+// Flush deletes all entries from the specified set.
+func (h *Handle) Flush(setName string, opts ...Opt) error {
+	if err := checkSetName("flush", setName); err != nil {
+		return err
+	}
+	return h.flush(setName)
+}
+
+// FlushAll deletes all entries from all sets.
+func (h *Handle) FlushAll(opts ...Opt) error {
+	return h.flush("")
+}
+
+func (h *Handle) flush(setName string) error {
+	req, err := h.newRequest(IPSET_CMD_FLUSH)
+	if err != nil {
+		return err
+	}
+	// without IPSET_ATTR_SETNAME kernel flushes all sets
+	if setName != "" {
+		req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(setName)))
+	}
+	h.l.Debugf("flush %v", req.Serialize())
+	_, err = req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
+// Rename renames a set. It returns ErrSetNameExist if a set named to already exists
+// and ErrSetReferenced if the set is referenced by kernel components, e.g. iptables rules or list:set sets.
+func (h *Handle) Rename(from, to string, opts ...Opt) error {
+	if err := checkSetName("rename", from); err != nil {
+		return err
+	}
+	if err := checkSetName("rename", to); err != nil {
+		return err
+	}
+	req, err := h.newRequest(IPSET_CMD_RENAME)
+	if err != nil {
+		return err
+	}
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(from)))
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME2, nl.ZeroTerminated(to)))
+	h.l.Debugf("rename %v", req.Serialize())
+	if _, err = req.Execute(unix.NETLINK_NETFILTER, 0); err != nil {
+		if errno := TryConvertErrno(err); errno != nil {
+			switch *errno {
+			case IPSET_ERR_EXIST_SETNAME2:
+				return ErrSetNameExist
+			case IPSET_ERR_REFERENCED:
+				return ErrSetReferenced
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Swap exchanges the name of two sets, i.e. swaps the contents of them.
+// Both sets must exist and only sets of compatible types can be swapped.
+func (h *Handle) Swap(a, b string, opts ...Opt) error {
+	if err := checkSetName("swap", a); err != nil {
+		return err
+	}
+	if err := checkSetName("swap", b); err != nil {
+		return err
+	}
+	req, err := h.newRequest(IPSET_CMD_SWAP)
+	if err != nil {
+		return err
+	}
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(a)))
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME2, nl.ZeroTerminated(b)))
+	h.l.Debugf("swap %v", req.Serialize())
+	_, err = req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
+// Replace atomically replaces all entries of the existing set with the given entries.
+// It creates a temporary set with the same header as set, fills it, swaps it with set and destroys it
+// afterwards, so that set is never seen half populated. The temporary set is destroyed if any step fails.
+func (h *Handle) Replace(set *IPSet, entries []Entry, opts ...Opt) error {
+	if err := checkSetName("replace", set.Name); err != nil {
+		return err
+	}
+	tmp := *set
+	tmp.Name = tempSetName(set.Name)
+	if err := h.Create(&tmp, opts...); err != nil {
+		return fmt.Errorf("failed to create temporary set %s: %v", tmp.Name, err)
+	}
+	for i := range entries {
+		if err := h.Add(&tmp, &entries[i], opts...); err != nil {
+			h.destroyTemp(tmp.Name)
+			return fmt.Errorf("failed to add entry %+v to temporary set %s: %v", entries[i], tmp.Name, err)
+		}
+	}
+	if err := h.Swap(tmp.Name, set.Name); err != nil {
+		h.destroyTemp(tmp.Name)
+		return fmt.Errorf("failed to swap temporary set %s with %s: %v", tmp.Name, set.Name, err)
+	}
+	// the temporary set holds the old entries now
+	return h.Destroy(tmp.Name)
+}
+
+func (h *Handle) destroyTemp(setName string) {
+	if err := h.Destroy(setName); err != nil {
+		h.l.Infof("failed to destroy temporary set %s: %v", setName, err)
+	}
+}
+
+// tempSetName returns a temporary set name derived from setName which fits in IPSET_MAXNAMELEN
+func tempSetName(setName string) string {
+	suffix := fmt.Sprintf("-tmp%08x", uint32(time.Now().UnixNano()))
+	if max := IPSET_MAXNAMELEN - 1 - len(suffix); len(setName) > max {
+		setName = setName[:max]
+	}
+	return setName + suffix
+}
+
+// GetByName returns the kernel index and family of the set
+func (h *Handle) GetByName(setName string, opts ...Opt) (*SetIndex, error) {
+	if err := checkSetName("get by name", setName); err != nil {
+		return nil, err
+	}
+	req, err := h.newRequest(IPSET_CMD_GET_BYNAME)
+	if err != nil {
+		return nil, err
+	}
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(setName)))
+	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseSetIndex(msgs)
+	if err != nil {
+		return nil, err
+	}
+	index.Name = setName
+	return index, nil
+}
+
+// GetByIndex returns the name and family of the set with the kernel index
+func (h *Handle) GetByIndex(index uint16, opts ...Opt) (*SetIndex, error) {
+	req, err := h.newRequest(IPSET_CMD_GET_BYINDEX)
+	if err != nil {
+		return nil, err
+	}
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_INDEX|unix.NLA_F_NET_BYTEORDER, htons(index)))
+	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	if err != nil {
+		return nil, err
+	}
+	setIndex, err := parseSetIndex(msgs)
+	if err != nil {
+		return nil, err
+	}
+	setIndex.Index = index
+	if setIndex.Family == "" {
+		// kernel replies the set name only, get the family by name
+		byName, err := h.GetByName(setIndex.Name)
+		if err != nil {
+			return nil, err
+		}
+		if byName.Index != index {
+			return nil, fmt.Errorf("set %s is moved from index %d to %d", setIndex.Name, index, byName.Index)
+		}
+		setIndex.Family = byName.Family
+	}
+	return setIndex, nil
+}
+
+func parseSetIndex(msgs [][]byte) (*SetIndex, error) {
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("no reply msg")
+	}
+	if len(msgs[0]) < SizeofNFGenMsg {
+		return nil, fmt.Errorf("possible corrupt msg %v", msgs[0])
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][SizeofNFGenMsg:])
+	if err != nil {
+		return nil, fmt.Errorf("possible corrupt msg %v", msgs[0])
+	}
+	var index SetIndex
+	for i := range attrs {
+		switch attrs[i].Attr.Type {
+		case IPSET_ATTR_SETNAME:
+			index.Name = string(attrs[i].Value[:len(attrs[i].Value)-1])
+		case IPSET_ATTR_FAMILY:
+			if attrs[i].Attr.Len != unix.SizeofRtAttr+1 {
+				return nil, fmt.Errorf("possible corrupt msg %v", msgs[0])
+			}
+			index.Family = familyName(attrs[i].Value[0])
+		case IPSET_ATTR_INDEX | unix.NLA_F_NET_BYTEORDER:
+			if attrs[i].Attr.Len != unix.SizeofRtAttr+2 {
+				return nil, fmt.Errorf("possible corrupt msg %v", msgs[0])
+			}
+			index.Index = ntohs(attrs[i].Value)
+		}
+	}
+	return &index, nil
+}
+
+// checkSetName checks the set name is not empty and fits in IPSET_MAXNAMELEN including the terminating zero
+func checkSetName(command, setName string) error {
+	if setName == "" {
+		return fmt.Errorf("invalid %s command: missing setname", command)
+	}
+	if len(setName) >= IPSET_MAXNAMELEN {
+		return fmt.Errorf("invalid %s command: setname %q is longer than %d", command, setName, IPSET_MAXNAMELEN-1)
+	}
+	return nil
+}
+
+// fillRevision adds the specified revision, or the max revision supported by kernel if it is nil, and returns it
+func (h *Handle) fillRevision(req *nl.NetlinkRequest, setType SetType, revision *uint8) (uint8, error) {
 	var revisions []uint8
 	revisionLock.RLock()
 	cached, ok := setRevisionMap[setType]
@@ -83,7 +316,7 @@ func (h *Handle) fillRevision(req *nl.NetlinkRequest, setType SetType, revision
 	} else {
 		max, min, err := h.getRevision(setType)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		revisions = []uint8{min, max}
 		revisionLock.Lock()
@@ -92,18 +325,216 @@ func (h *Handle) fillRevision(req *nl.NetlinkRequest, setType SetType, revision
 	}
 	if revision != nil {
 		if *revision < revisions[0] {
-			return fmt.Errorf("revision %d is smaller than min supported %d", *revision, revisions[0])
+			return 0, fmt.Errorf("revision %d is smaller than min supported %d", *revision, revisions[0])
 		}
 		if *revision > revisions[1] {
-			return fmt.Errorf("revision %d is larger than max supported %d", *revision, revisions[1])
+			return 0, fmt.Errorf("revision %d is larger than max supported %d", *revision, revisions[1])
 		}
 		req.AddData(nl.NewRtAttr(IPSET_ATTR_REVISION, nl.Uint8Attr(uint8(*revision))))
-	} else {
-		req.AddData(nl.NewRtAttr(IPSET_ATTR_REVISION, nl.Uint8Attr(uint8(revisions[1]))))
+		return *revision, nil
+	}
+	req.AddData(nl.NewRtAttr(IPSET_ATTR_REVISION, nl.Uint8Attr(uint8(revisions[1]))))
+	return revisions[1], nil
+}
+
+// bucketSizeRevisions are the first revisions of hash types which support bucketsize and initval, check
+// ipset/lib/ipset_hash_*.c. Earlier revisions accept probes and resize instead.
+var bucketSizeRevisions = map[SetType]uint8{
+	HashIP:         5,
+	HashMac:        1,
+	HashIPMac:      1,
+	HashNet:        7,
+	HashNetNet:     3,
+	HashIPPort:     6,
+	HashNetPort:    8,
+	HashIPPortIP:   6,
+	HashIPPortNet:  8,
+	HashIPMark:     3,
+	HashNetPortNet: 3,
+	HashNetIface:   8,
+}
+
+// netmaskRevisions are the first revisions of set types which support netmask, check ipset/lib/ipset_*.c.
+var netmaskRevisions = map[SetType]uint8{
+	BitmapIP:   0,
+	HashIP:     0,
+	HashNetNet: 4,
+}
+
+// fillCreateData adds the type specific create data of set of the revision
+func fillCreateData(req *nl.NetlinkRequest, set *IPSet, revision uint8) error {
+	dataAttr := nl.NewRtAttr(IPSET_ATTR_DATA|unix.NLA_F_NESTED, nil)
+	if set.Timeout != nil {
+		dataAttr.AddRtAttr(IPSET_ATTR_TIMEOUT|unix.NLA_F_NET_BYTEORDER, htonl(*set.Timeout))
+	}
+	var cadtFlags uint32
+	if set.WithCounters {
+		cadtFlags |= IPSET_FLAG_WITH_COUNTERS
+	}
+	if set.WithComment {
+		cadtFlags |= IPSET_FLAG_WITH_COMMENT
+	}
+	if set.WithSkbInfo {
+		cadtFlags |= IPSET_FLAG_WITH_SKBINFO
+	}
+	if set.WithForceAdd {
+		if !isHashType(set.SetType) {
+			return fmt.Errorf("invalid create command: forceadd is not supported by setType %s", set.SetType)
+		}
+		cadtFlags |= IPSET_FLAG_WITH_FORCEADD
+	}
+	if cadtFlags != 0 {
+		dataAttr.AddRtAttr(IPSET_ATTR_CADT_FLAGS|unix.NLA_F_NET_BYTEORDER, htonl(cadtFlags))
+	}
+	if set.Size != 0 {
+		if set.SetType != ListSet {
+			return fmt.Errorf("invalid create command: size is not supported by setType %s", set.SetType)
+		}
+		dataAttr.AddRtAttr(IPSET_ATTR_SIZE|unix.NLA_F_NET_BYTEORDER, htonl(set.Size))
+	}
+	if set.HashSize != 0 || set.MaxElem != 0 {
+		if !isHashType(set.SetType) {
+			return fmt.Errorf("invalid create command: hashsize and maxelem are not supported by setType %s", set.SetType)
+		}
+		if set.HashSize < 0 || int64(set.HashSize) > math.MaxUint32 || set.MaxElem < 0 || int64(set.MaxElem) > math.MaxUint32 {
+			return fmt.Errorf("invalid create command: bad hashsize %d or maxelem %d", set.HashSize, set.MaxElem)
+		}
+		if set.HashSize != 0 {
+			dataAttr.AddRtAttr(IPSET_ATTR_HASHSIZE|unix.NLA_F_NET_BYTEORDER, htonl(uint32(set.HashSize)))
+		}
+		if set.MaxElem != 0 {
+			dataAttr.AddRtAttr(IPSET_ATTR_MAXELEM|unix.NLA_F_NET_BYTEORDER, htonl(uint32(set.MaxElem)))
+		}
+	}
+	if set.IPRange != "" {
+		if set.SetType != BitmapIP && set.SetType != BitmapIPMac {
+			return fmt.Errorf("invalid create command: range is not supported by setType %s", set.SetType)
+		}
+		if err := fillIPRange(dataAttr, set); err != nil {
+			return err
+		}
+	}
+	if set.PortRange != "" {
+		if set.SetType != BitmapPort {
+			return fmt.Errorf("invalid create command: port range is not supported by setType %s", set.SetType)
+		}
+		from, to, err := parsePortRange(set.PortRange)
+		if err != nil {
+			return fmt.Errorf("invalid create command: %v", err)
+		}
+		if to == 0 {
+			return fmt.Errorf("invalid create command: port range %s is not in the form of port-port", set.PortRange)
+		}
+		dataAttr.AddRtAttr(IPSET_ATTR_PORT|unix.NLA_F_NET_BYTEORDER, htons(from))
+		dataAttr.AddRtAttr(IPSET_ATTR_PORT_TO|unix.NLA_F_NET_BYTEORDER, htons(to))
+	}
+	if set.MarkMask != 0 {
+		if set.SetType != HashIPMark {
+			return fmt.Errorf("invalid create command: markmask is not supported by setType %s", set.SetType)
+		}
+		dataAttr.AddRtAttr(IPSET_ATTR_MARKMASK|unix.NLA_F_NET_BYTEORDER, htonl(set.MarkMask))
+	}
+	if set.Netmask != 0 {
+		netmaskRevision, ok := netmaskRevisions[set.SetType]
+		if !ok {
+			return fmt.Errorf("invalid create command: netmask is not supported by setType %s", set.SetType)
+		}
+		if revision < netmaskRevision {
+			return fmt.Errorf("invalid create command: netmask requires revision %d of setType %s, real %d",
+				netmaskRevision, set.SetType, revision)
+		}
+		dataAttr.AddRtAttr(IPSET_ATTR_NETMASK, nl.Uint8Attr(set.Netmask))
+	}
+	if set.Probes != 0 || set.Resize != 0 || set.BucketSize != 0 || set.InitVal != nil {
+		if err := fillHashTuning(dataAttr, set, revision); err != nil {
+			return err
+		}
 	}
+	req.AddData(dataAttr)
 	return nil
 }
 
+func isHashType(setType SetType) bool {
+	return strings.HasPrefix(string(setType), "hash:")
+}
+
+// fillHashTuning adds probes and resize, or bucketsize and initval, depending on which are supported by the revision
+func fillHashTuning(parent *nl.RtAttr, set *IPSet, revision uint8) error {
+	bucketSizeRevision, ok := bucketSizeRevisions[set.SetType]
+	if !ok {
+		return fmt.Errorf("invalid create command: probes, resize, bucketsize and initval are not supported by setType %s", set.SetType)
+	}
+	if revision >= bucketSizeRevision {
+		if set.Probes != 0 || set.Resize != 0 {
+			return fmt.Errorf("invalid create command: probes and resize are not supported by revision %d of setType %s, "+
+				"which supports bucketsize and initval", revision, set.SetType)
+		}
+		if set.BucketSize != 0 {
+			parent.AddRtAttr(IPSET_ATTR_BUCKETSIZE, nl.Uint8Attr(set.BucketSize))
+		}
+		if set.InitVal != nil {
+			parent.AddRtAttr(IPSET_ATTR_INITVAL|unix.NLA_F_NET_BYTEORDER, htonl(*set.InitVal))
+		}
+		return nil
+	}
+	if set.BucketSize != 0 || set.InitVal != nil {
+		return fmt.Errorf("invalid create command: bucketsize and initval require revision %d of setType %s, real %d",
+			bucketSizeRevision, set.SetType, revision)
+	}
+	if set.Probes != 0 {
+		parent.AddRtAttr(IPSET_ATTR_PROBES, nl.Uint8Attr(set.Probes))
+	}
+	if set.Resize != 0 {
+		parent.AddRtAttr(IPSET_ATTR_RESIZE, nl.Uint8Attr(set.Resize))
+	}
+	return nil
+}
+
+// fillIPRange adds IPSET_ATTR_IP with IPSET_ATTR_IP_TO or IPSET_ATTR_CIDR of the range ip-ip or ip/cidr
+func fillIPRange(parent *nl.RtAttr, set *IPSet) error {
+	from, to, ok, err := parseIPRange(set.IPRange)
+	if err != nil {
+		return fmt.Errorf("invalid create command: %v", err)
+	}
+	if ok {
+		if err := fillIPAddr(parent, IPSET_ATTR_IP, set, from); err != nil {
+			return err
+		}
+		return fillIPAddr(parent, IPSET_ATTR_IP_TO, set, to)
+	}
+	ip, cidr, err := parseCIDR(set.IPRange)
+	if err != nil {
+		return fmt.Errorf("invalid create command: %v", err)
+	}
+	if cidr == nil {
+		return fmt.Errorf("invalid create command: range %s is neither ip-ip nor ip/cidr", set.IPRange)
+	}
+	if err := fillIPAddr(parent, IPSET_ATTR_IP, set, ip); err != nil {
+		return err
+	}
+	parent.AddRtAttr(IPSET_ATTR_CIDR, nl.Uint8Attr(*cidr))
+	return nil
+}
+
+// fillExist sets IPSET_FLAG_EXIST if opts has IPSET_OPT_EXIST, which ignores the error of creating an identical
+// existing set, adding an existing entry or deleting a missing entry. Kernel sets IPSET_FLAG_EXIST for the requests
+// without NLM_F_EXCL.
+func fillExist(req *nl.NetlinkRequest, opts []Opt) {
+	if hasOpt(opts, IPSET_OPT_EXIST) {
+		req.Flags &^= unix.NLM_F_EXCL
+	}
+}
+
+func familyName(family uint8) string {
+	switch family {
+	case NFPROTO_IPV4:
+		return "inet"
+	case NFPROTO_IPV6:
+		return "inet6"
+	}
+	return ""
+}
+
 func fillFamily(req *nl.NetlinkRequest, hashFamily string) {
 	switch hashFamily {
 	case "inet6":
@@ -130,29 +561,35 @@ func fillFamily(req *nl.NetlinkRequest, hashFamily string) {
 //Command attributes:
 //PROTOCOL: 6
 func (h *Handle) protocol() (uint8, error) {
+	max, _, err := h.protocolRange()
+	return max, err
+}
+
+// protocolRange returns the max and min protocol versions supported by kernel
+func (h *Handle) protocolRange() (uint8, uint8, error) {
 	req, err := h.newRequest(IPSET_CMD_PROTOCOL)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	var min, max uint8
 	for i := range msgs {
 		if len(msgs[i]) < SizeofNFGenMsg {
-			return 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
+			return 0, 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
 		}
 		//nlGenlMsg := DeserializeNFGenlMsg(msgs[i])
 		attrs, err := nl.ParseRouteAttr(msgs[i][SizeofNFGenMsg:])
 		if err != nil {
-			return 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
+			return 0, 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
 		}
 		for i := range attrs {
 			switch attrs[i].Attr.Type {
 			case IPSET_ATTR_PROTOCOL:
 				if attrs[i].Attr.Len != unix.SizeofRtAttr+1 {
-					return 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
+					return 0, 0, fmt.Errorf("possible corrupt msg %v", msgs[i])
 				}
 				max = uint8(attrs[i].Value[0])
 				if min == 0 {
@@ -165,13 +602,34 @@ func (h *Handle) protocol() (uint8, error) {
 		break
 	}
 	h.l.Debugf("supported protocol %d, min supported %d", max, min)
-	return max, nil
+	return max, min, nil
 }
 
 func (h *Handle) List(setName string, opts ...Opt) ([]ListItem, error) {
+	return h.dump(IPSET_CMD_LIST, setName, 0)
+}
+
+// Header returns the type, family, revision and create data of the set without transferring any entries.
+// IPSET_CMD_HEADER reports type, family and revision only, so it dumps the set header with IPSET_FLAG_LIST_HEADER.
+func (h *Handle) Header(setName string, opts ...Opt) (*ListItem, error) {
+	if err := checkSetName("header", setName); err != nil {
+		return nil, err
+	}
+	sets, err := h.dump(IPSET_CMD_LIST, setName, IPSET_FLAG_LIST_HEADER)
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) != 1 {
+		return nil, fmt.Errorf("expect header of set %s, real %d sets", setName, len(sets))
+	}
+	return &sets[0], nil
+}
+
+func (h *Handle) dump(cmd int, setName string, flags uint32) ([]ListItem, error) {
 	//req:	msg:	IPSET_CMD_LIST|SAVE
 	//attr:	IPSET_ATTR_PROTOCOL
 	//	IPSET_ATTR_SETNAME	(optional)
+	//	IPSET_ATTR_FLAGS	(optional)
 	//
 	//resp:	attr:	IPSET_ATTR_SETNAME
 	//		IPSET_ATTR_TYPENAME
@@ -186,14 +644,16 @@ func (h *Handle) List(setName string, opts ...Opt) ([]ListItem, error) {
 	//			IPSET_ATTR_DATA
 	//				adt-specific-data
 	//		...
-	req, err := h.newRequest(IPSET_CMD_LIST)
+	req, err := h.newRequest(cmd)
 	if err != nil {
 		return nil, err
 	}
 	if setName != "" {
 		req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(setName)))
 	}
-	req.AddData(nl.NewRtAttr(IPSET_ATTR_FLAGS, nl.Uint32Attr(IPSET_FLAG_LIST_SETNAME|IPSET_FLAG_LIST_HEADER)))
+	if flags != 0 {
+		req.AddData(nl.NewRtAttr(IPSET_ATTR_FLAGS|unix.NLA_F_NET_BYTEORDER, htonl(flags)))
+	}
 	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
 	if err != nil {
 		return nil, err
@@ -230,27 +690,10 @@ func (h *Handle) List(setName string, opts ...Opt) ([]ListItem, error) {
 				if attrs[i].Attr.Len != unix.SizeofRtAttr+1 {
 					return nil, fmt.Errorf("possible corrupt msg %v", msgs[k])
 				}
-				switch attrs[i].Value[0] {
-				case NFPROTO_IPV4:
-					ipset.Family = "inet"
-				case NFPROTO_IPV6:
-					ipset.Family = "inet6"
-				}
+				ipset.Family = familyName(attrs[i].Value[0])
 			case IPSET_ATTR_DATA | unix.NLA_F_NESTED:
-				nestAttrs, err := nl.ParseRouteAttr(attrs[i].Value)
-				if err != nil {
-					return nil, fmt.Errorf("possible corrupt msg %v", msgs[k])
-				}
-				for j := range nestAttrs {
-					switch nestAttrs[j].Attr.Type {
-					default:
-						// TODO Parse create attr
-						//HASHSIZE: 1024
-						//MAXELEM: 65536
-						//REFERENCES: 0
-						//MEMSIZE: 176
-						//log.Infof("unknown attr %v", nestAttrs[j].Attr.Type)
-					}
+				if err := parseCreateData(&ipset, attrs[i].Value); err != nil {
+					return nil, err
 				}
 			case IPSET_ATTR_ADT | unix.NLA_F_NESTED:
 				entries, err := parseAdtAttr(attrs[i].Value)
@@ -260,11 +703,114 @@ func (h *Handle) List(setName string, opts ...Opt) ([]ListItem, error) {
 				ipset.Entries = append(ipset.Entries, entries...)
 			}
 		}
+		// entries of a large set are split into several msgs, only the first one has the header
+		if n := len(sets); n > 0 && ipset.SetType == "" && sets[n-1].Name == ipset.Name {
+			sets[n-1].Entries = append(sets[n-1].Entries, ipset.Entries...)
+			continue
+		}
 		sets = append(sets, ipset)
 	}
 	return sets, nil
 }
 
+func parseCreateData(ipset *ListItem, data []byte) error {
+	nestAttrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return fmt.Errorf("possible corrupt create data msg %v", data)
+	}
+	var ipFrom, ipTo string
+	var portFrom, portTo uint16
+	for j := range nestAttrs {
+		switch nestAttrs[j].Attr.Type {
+		case IPSET_ATTR_PORT | unix.NLA_F_NET_BYTEORDER, IPSET_ATTR_PORT_TO | unix.NLA_F_NET_BYTEORDER:
+			if nestAttrs[j].Attr.Len != unix.SizeofRtAttr+2 {
+				return fmt.Errorf("possible corrupt create data msg %v", nestAttrs)
+			}
+			if nestAttrs[j].Attr.Type == IPSET_ATTR_PORT|unix.NLA_F_NET_BYTEORDER {
+				portFrom = ntohs(nestAttrs[j].Value)
+			} else {
+				portTo = ntohs(nestAttrs[j].Value)
+			}
+		case IPSET_ATTR_IP | unix.NLA_F_NESTED, IPSET_ATTR_IP_TO | unix.NLA_F_NESTED:
+			ip, err := parseIP(nestAttrs[j].Value)
+			if err != nil {
+				return err
+			}
+			if nestAttrs[j].Attr.Type == IPSET_ATTR_IP|unix.NLA_F_NESTED {
+				ipFrom = ip.String()
+			} else {
+				ipTo = ip.String()
+			}
+		case IPSET_ATTR_NETMASK, IPSET_ATTR_BUCKETSIZE, IPSET_ATTR_RESIZE:
+			if nestAttrs[j].Attr.Len != unix.SizeofRtAttr+1 {
+				return fmt.Errorf("possible corrupt create data msg %v", nestAttrs)
+			}
+			switch nestAttrs[j].Attr.Type {
+			case IPSET_ATTR_NETMASK:
+				ipset.Netmask = nestAttrs[j].Value[0]
+			case IPSET_ATTR_BUCKETSIZE:
+				ipset.BucketSize = nestAttrs[j].Value[0]
+			case IPSET_ATTR_RESIZE:
+				ipset.Resize = nestAttrs[j].Value[0]
+			}
+		case IPSET_ATTR_MARKMASK:
+			// kernel puts markmask in host byte order without NLA_F_NET_BYTEORDER
+			if nestAttrs[j].Attr.Len != unix.SizeofRtAttr+4 {
+				return fmt.Errorf("possible corrupt create data msg %v", nestAttrs)
+			}
+			ipset.MarkMask = endian.Uint32(nestAttrs[j].Value)
+		case IPSET_ATTR_HASHSIZE | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_MAXELEM | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_REFERENCES | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_MEMSIZE | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_ELEMENTS | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_TIMEOUT | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_CADT_FLAGS | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_MARKMASK | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_INITVAL | unix.NLA_F_NET_BYTEORDER,
+			IPSET_ATTR_SIZE | unix.NLA_F_NET_BYTEORDER:
+			if nestAttrs[j].Attr.Len != unix.SizeofRtAttr+4 {
+				return fmt.Errorf("possible corrupt create data msg %v", nestAttrs)
+			}
+			val := ntohl(nestAttrs[j].Value)
+			switch nestAttrs[j].Attr.Type &^ unix.NLA_F_NET_BYTEORDER {
+			case IPSET_ATTR_HASHSIZE:
+				ipset.HashSize = int(val)
+			case IPSET_ATTR_MAXELEM:
+				ipset.MaxElem = int(val)
+			case IPSET_ATTR_REFERENCES:
+				ipset.References = val
+			case IPSET_ATTR_MEMSIZE:
+				ipset.MemSize = val
+			case IPSET_ATTR_ELEMENTS:
+				ipset.Elements = val
+			case IPSET_ATTR_TIMEOUT:
+				ipset.Timeout = &val
+			case IPSET_ATTR_CADT_FLAGS:
+				ipset.WithCounters = val&IPSET_FLAG_WITH_COUNTERS != 0
+				ipset.WithComment = val&IPSET_FLAG_WITH_COMMENT != 0
+				ipset.WithSkbInfo = val&IPSET_FLAG_WITH_SKBINFO != 0
+				ipset.WithForceAdd = val&IPSET_FLAG_WITH_FORCEADD != 0
+			case IPSET_ATTR_MARKMASK:
+				ipset.MarkMask = val
+			case IPSET_ATTR_INITVAL:
+				ipset.InitVal = &val
+			case IPSET_ATTR_SIZE:
+				ipset.Size = val
+			}
+		default:
+			// ignore type specific create data which is not supported now
+		}
+	}
+	if ipFrom != "" {
+		ipset.IPRange = ipFrom + "-" + ipTo
+	}
+	if ipset.SetType == BitmapPort {
+		ipset.PortRange = fmt.Sprintf("%d-%d", portFrom, portTo)
+	}
+	return nil
+}
+
 func parseAdtAttr(data []byte) ([]Entry, error) {
 	nestAttrs, err := nl.ParseRouteAttr(data)
 	if err != nil {
@@ -281,17 +827,23 @@ func parseAdtAttr(data []byte) ([]Entry, error) {
 			}
 			for k := range nestGrandAttrs {
 				switch nestGrandAttrs[k].Attr.Type {
-				case IPSET_ATTR_IP | unix.NLA_F_NESTED:
-					fallthrough
-				case IPSET_ATTR_IP2 | unix.NLA_F_NESTED:
+				case IPSET_ATTR_IP | unix.NLA_F_NESTED,
+					IPSET_ATTR_IP_TO | unix.NLA_F_NESTED,
+					IPSET_ATTR_IP2 | unix.NLA_F_NESTED,
+					IPSET_ATTR_IP2_TO | unix.NLA_F_NESTED:
 					ip, err := parseIP(nestGrandAttrs[k].Value)
 					if err != nil {
 						return nil, err
 					}
-					if nestGrandAttrs[k].Attr.Type == IPSET_ATTR_IP2|unix.NLA_F_NESTED {
-						entry.IP2 = ip.String()
-					} else {
+					switch nestGrandAttrs[k].Attr.Type &^ unix.NLA_F_NESTED {
+					case IPSET_ATTR_IP:
 						entry.IP = ip.String()
+					case IPSET_ATTR_IP_TO:
+						entry.IPTo = ip.String()
+					case IPSET_ATTR_IP2:
+						entry.IP2 = ip.String()
+					case IPSET_ATTR_IP2_TO:
+						entry.IP2To = ip.String()
 					}
 				case IPSET_ATTR_CIDR:
 					fallthrough
@@ -316,11 +868,67 @@ func parseAdtAttr(data []byte) ([]Entry, error) {
 					}
 					port := ntohs(nestGrandAttrs[k].Value)
 					entry.Port = uint16(port)
+				case IPSET_ATTR_MARK | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+4 {
+						return nil, fmt.Errorf("possible corrupt mark msg %v", nestGrandAttrs)
+					}
+					entry.Mark = ntohl(nestGrandAttrs[k].Value)
+				case IPSET_ATTR_NAME:
+					entry.Name = string(nestGrandAttrs[k].Value[:len(nestGrandAttrs[k].Value)-1])
+				case IPSET_ATTR_NAMEREF:
+					entry.NameRef = string(nestGrandAttrs[k].Value[:len(nestGrandAttrs[k].Value)-1])
+				case IPSET_ATTR_TIMEOUT | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+4 {
+						return nil, fmt.Errorf("possible corrupt timeout msg %v", nestGrandAttrs)
+					}
+					timeout := ntohl(nestGrandAttrs[k].Value)
+					entry.Timeout = &timeout
+				case IPSET_ATTR_PACKETS | unix.NLA_F_NET_BYTEORDER, IPSET_ATTR_BYTES | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+8 {
+						return nil, fmt.Errorf("possible corrupt counter msg %v", nestGrandAttrs)
+					}
+					counter := ntohll(nestGrandAttrs[k].Value)
+					if nestGrandAttrs[k].Attr.Type == IPSET_ATTR_PACKETS|unix.NLA_F_NET_BYTEORDER {
+						entry.Packets = &counter
+					} else {
+						entry.Bytes = &counter
+					}
+				case IPSET_ATTR_COMMENT:
+					entry.Comment = string(nestGrandAttrs[k].Value[:len(nestGrandAttrs[k].Value)-1])
+				case IPSET_ATTR_SKBMARK | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+8 {
+						return nil, fmt.Errorf("possible corrupt skbmark msg %v", nestGrandAttrs)
+					}
+					mark := ntohll(nestGrandAttrs[k].Value)
+					entry.SkbMark, entry.SkbMarkMask = uint32(mark>>32), uint32(mark)
+				case IPSET_ATTR_SKBPRIO | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+4 {
+						return nil, fmt.Errorf("possible corrupt skbprio msg %v", nestGrandAttrs)
+					}
+					entry.SkbPrio = ntohl(nestGrandAttrs[k].Value)
+				case IPSET_ATTR_SKBQUEUE | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+2 {
+						return nil, fmt.Errorf("possible corrupt skbqueue msg %v", nestGrandAttrs)
+					}
+					entry.SkbQueue = ntohs(nestGrandAttrs[k].Value)
+				case IPSET_ATTR_IFACE:
+					entry.Iface = string(nestGrandAttrs[k].Value[:len(nestGrandAttrs[k].Value)-1])
+				case IPSET_ATTR_CADT_FLAGS | unix.NLA_F_NET_BYTEORDER:
+					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+4 {
+						return nil, fmt.Errorf("possible corrupt cadt flags msg %v", nestGrandAttrs)
+					}
+					flags := ntohl(nestGrandAttrs[k].Value)
+					entry.PhysDev = flags&IPSET_FLAG_PHYSDEV != 0
+					entry.Wildcard = flags&IPSET_FLAG_IFACE_WILDCARD != 0
+					entry.Before = flags&IPSET_FLAG_BEFORE != 0
+					entry.NoMatch = flags&IPSET_FLAG_NOMATCH != 0
 				case IPSET_ATTR_PROTO:
 					if nestGrandAttrs[k].Attr.Len != unix.SizeofRtAttr+1 {
 						return nil, fmt.Errorf("possible corrupt port msg %v", nestGrandAttrs)
 					}
 					entry.Proto = uint8(nestGrandAttrs[k].Value[0])
+				case IPSET_ATTR_PAD:
+					// kernel may pad 64 bit attrs, e.g. counters and skbmark, to align them
 				default:
 					return nil, fmt.Errorf("unknown attr %v", nestGrandAttrs[k].Attr.Type)
 				}
@@ -345,21 +953,77 @@ func parseIP(ipData []byte) (net.IP, error) {
 				return nil, fmt.Errorf("possible corrupt ip msg %v", ipData)
 			}
 			return net.IP(nestAttrs[i].Value), nil
-			//TODO ipv6
+		case IPSET_ATTR_IPADDR_IPV6:
+			if nestAttrs[i].Attr.Len != unix.SizeofRtAttr+16 {
+				return nil, fmt.Errorf("possible corrupt ip msg %v", ipData)
+			}
+			return net.IP(nestAttrs[i].Value), nil
 		}
 	}
 	return nil, fmt.Errorf("possible corrupt ip msg %v, nestAttrs %v", ipData, nestAttrs)
 }
 
 func (h *Handle) Add(set *IPSet, entry *Entry, opts ...Opt) error {
-	return h.addOrDel(IPSET_CMD_ADD, set, entry, opts...)
+	return h.adt(IPSET_CMD_ADD, set, entry, 0, 0, opts...)
 }
 
 func (h *Handle) Del(set *IPSet, entry *Entry, opts ...Opt) error {
-	return h.addOrDel(IPSET_CMD_DEL, set, entry, opts...)
+	return h.adt(IPSET_CMD_DEL, set, entry, 0, 0, opts...)
 }
 
-func (h *Handle) addOrDel(command int, set *IPSet, entry *Entry, opts ...Opt) error {
+// TestResult is the result of TestEntry
+type TestResult int
+
+const (
+	// TestResultNotIn means entry is not in set
+	TestResultNotIn TestResult = iota
+	// TestResultIn means entry is in set
+	TestResultIn
+	// TestResultNoMatch means entry is matched by a nomatch entry of hash:net* sets, so it is not in set
+	TestResultNoMatch
+)
+
+// Test tests whether entry is in set. It returns false and nil error if entry is not in set, including if entry is
+// matched by a nomatch entry. If entry.NoMatch is true, it tests whether entry is matched by a nomatch entry.
+func (h *Handle) Test(set *IPSet, entry *Entry, opts ...Opt) (bool, error) {
+	err := h.adt(IPSET_CMD_TEST, set, entry, 0, 0, opts...)
+	if err == nil {
+		return true, nil
+	}
+	if isErrno(err, IPSET_ERR_EXIST) {
+		return false, nil
+	}
+	return false, err
+}
+
+// TestEntry is like Test but tells whether entry is matched by a nomatch entry of hash:net* sets which support nomatch
+// entries. It costs an extra TEST request for each entry not in these sets.
+func (h *Handle) TestEntry(set *IPSet, entry *Entry, opts ...Opt) (TestResult, error) {
+	err := h.adt(IPSET_CMD_TEST, set, entry, 0, 0, opts...)
+	if err == nil {
+		return TestResultIn, nil
+	}
+	if !isErrno(err, IPSET_ERR_EXIST) {
+		return TestResultNotIn, err
+	}
+	if !nomatchSetTypes[set.SetType] || entry.NoMatch {
+		return TestResultNotIn, nil
+	}
+	// kernel reports the same IPSET_ERR_EXIST for missing entries and nomatch entries, but succeeds
+	// only for nomatch entries if testing with IPSET_FLAG_NOMATCH
+	err = h.adt(IPSET_CMD_TEST, set, entry, IPSET_FLAG_NOMATCH, 0, opts...)
+	if err == nil {
+		return TestResultNoMatch, nil
+	}
+	if !isErrno(err, IPSET_ERR_EXIST) {
+		return TestResultNotIn, err
+	}
+	return TestResultNotIn, nil
+}
+
+// adt sends IPSET_CMD_ADD, IPSET_CMD_DEL or IPSET_CMD_TEST command of entry.
+// lineno is the line number of the command in a restore script, or 0.
+func (h *Handle) adt(command int, set *IPSet, entry *Entry, cadtFlags, lineno uint32, opts ...Opt) error {
 	if set.Name == "" {
 		return fmt.Errorf("invalid add command: missing setname")
 	}
@@ -369,19 +1033,60 @@ func (h *Handle) addOrDel(command int, set *IPSet, entry *Entry, opts ...Opt) er
 	}
 	req.AddData(nl.NewRtAttr(IPSET_ATTR_SETNAME, nl.ZeroTerminated(set.Name)))
 	dataAttr := nl.NewRtAttr(IPSET_ATTR_DATA|unix.NLA_F_NESTED, nil)
-	if err := fillEntries(dataAttr, set, entry); err != nil {
+	if err := fillEntries(dataAttr, set, entry, lineno); err != nil {
 		return err
 	}
+	entryFlags, err := entryCadtFlags(set, entry)
+	if err != nil {
+		return err
+	}
+	cadtFlags |= entryFlags
+	if cadtFlags != 0 {
+		dataAttr.AddRtAttr(IPSET_ATTR_CADT_FLAGS|unix.NLA_F_NET_BYTEORDER, htonl(cadtFlags))
+	}
 	req.AddData(dataAttr)
-	h.l.Debugf("addOrDel %v", req.Serialize())
+	fillExist(req, opts)
+	h.l.Debugf("adt %v", req.Serialize())
 	_, err = req.Execute(unix.NETLINK_NETFILTER, 0)
 	return err
 }
 
-type fillAddAttr func(parent *nl.RtAttr, entry *Entry) error
+// entryCadtFlags returns the cadt flags of the per entry options
+func entryCadtFlags(set *IPSet, entry *Entry) (uint32, error) {
+	var flags uint32
+	if entry.PhysDev || entry.Wildcard {
+		if set.SetType != HashNetIface {
+			return 0, fmt.Errorf("invalid add command: physdev and wildcard are not supported by setType %s", set.SetType)
+		}
+		if entry.PhysDev {
+			flags |= IPSET_FLAG_PHYSDEV
+		}
+		if entry.Wildcard {
+			flags |= IPSET_FLAG_IFACE_WILDCARD
+		}
+	}
+	if entry.NoMatch {
+		if !nomatchSetTypes[set.SetType] {
+			return 0, fmt.Errorf("invalid add command: nomatch is not supported by setType %s", set.SetType)
+		}
+		flags |= IPSET_FLAG_NOMATCH
+	}
+	if entry.Before {
+		if set.SetType != ListSet || entry.NameRef == "" {
+			return 0, fmt.Errorf("invalid add command: before requires a reference set name of list:set")
+		}
+		flags |= IPSET_FLAG_BEFORE
+	}
+	return flags, nil
+}
+
+type fillAddAttr func(parent *nl.RtAttr, set *IPSet, entry *Entry) error
 
 var setTypeFillFuncMap = map[SetType][]fillAddAttr{
 	HashIP:         {fillIP},
+	BitmapIP:       {fillIP},
+	BitmapIPMac:    {fillIP, fillOptionalMac},
+	BitmapPort:     {fillBitmapPort},
 	HashMac:        {fillMac},
 	HashIPMac:      {fillIP, fillMac},
 	HashNet:        {fillIP},
@@ -391,45 +1096,124 @@ var setTypeFillFuncMap = map[SetType][]fillAddAttr{
 	HashIPPortIP:   {fillIP, fillPort, fillIP2},
 	HashIPPortNet:  {fillIP, fillPort, fillIP2},
 	HashNetPortNet: {fillIP, fillPort, fillIP2},
+	HashIPMark:     {fillIP, fillMark},
+	HashNetIface:   {fillIP, fillIface},
+	ListSet:        {fillName},
+}
+
+// nomatchSetTypes are the set types which support nomatch entries
+var nomatchSetTypes = map[SetType]bool{
+	HashNet:        true,
+	HashNetNet:     true,
+	HashNetPort:    true,
+	HashIPPortNet:  true,
+	HashNetPortNet: true,
+	HashNetIface:   true,
 }
 
-func fillEntries(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+func fillEntries(parent *nl.RtAttr, set *IPSet, entry *Entry, lineno uint32) error {
 	if funcs, exist := setTypeFillFuncMap[set.SetType]; !exist {
 		return fmt.Errorf("adding entries for setType %s not supported now", set.SetType)
 	} else {
 		for i := range funcs {
-			if err := funcs[i](parent, entry); err != nil {
+			if err := funcs[i](parent, set, entry); err != nil {
 				return err
 			}
 		}
 	}
-	fillLineno(parent)
+	if err := fillExtensions(parent, entry); err != nil {
+		return err
+	}
+	fillLineno(parent, lineno)
+	return nil
+}
+
+// fillExtensions adds the extension values of entry which are supported by all set types
+func fillExtensions(parent *nl.RtAttr, entry *Entry) error {
+	if entry.Timeout != nil {
+		parent.AddRtAttr(IPSET_ATTR_TIMEOUT|unix.NLA_F_NET_BYTEORDER, htonl(*entry.Timeout))
+	}
+	if entry.Packets != nil {
+		parent.AddRtAttr(IPSET_ATTR_PACKETS|unix.NLA_F_NET_BYTEORDER, htonll(*entry.Packets))
+	}
+	if entry.Bytes != nil {
+		parent.AddRtAttr(IPSET_ATTR_BYTES|unix.NLA_F_NET_BYTEORDER, htonll(*entry.Bytes))
+	}
+	if entry.Comment != "" {
+		if len(entry.Comment) > IPSET_MAX_COMMENT_SIZE {
+			return fmt.Errorf("invalid add command: comment is longer than %d", IPSET_MAX_COMMENT_SIZE)
+		}
+		// comments are saved in double quotes without escaping
+		if strings.Contains(entry.Comment, `"`) {
+			return fmt.Errorf("invalid add command: comment %s contains \"", entry.Comment)
+		}
+		parent.AddRtAttr(IPSET_ATTR_COMMENT, nl.ZeroTerminated(entry.Comment))
+	}
+	if entry.SkbMark != 0 || entry.SkbMarkMask != 0 {
+		mask := entry.SkbMarkMask
+		if mask == 0 {
+			mask = 0xffffffff
+		}
+		parent.AddRtAttr(IPSET_ATTR_SKBMARK|unix.NLA_F_NET_BYTEORDER, htonll(uint64(entry.SkbMark)<<32|uint64(mask)))
+	}
+	if entry.SkbPrio != 0 {
+		parent.AddRtAttr(IPSET_ATTR_SKBPRIO|unix.NLA_F_NET_BYTEORDER, htonl(entry.SkbPrio))
+	}
+	if entry.SkbQueue != 0 {
+		parent.AddRtAttr(IPSET_ATTR_SKBQUEUE|unix.NLA_F_NET_BYTEORDER, htons(entry.SkbQueue))
+	}
 	return nil
 }
 
-func fillLineno(parent *nl.RtAttr) {
-	parent.AddRtAttr(IPSET_ATTR_LINENO|unix.NLA_F_NET_BYTEORDER, nl.Uint32Attr(0))
+func fillLineno(parent *nl.RtAttr, lineno uint32) {
+	parent.AddRtAttr(IPSET_ATTR_LINENO|unix.NLA_F_NET_BYTEORDER, htonl(lineno))
 }
 
-func fillIP(parent *nl.RtAttr, entry *Entry) error {
-	ip := net.ParseIP(entry.IP)
+func fillIP(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	if err := fillIPAddr(parent, IPSET_ATTR_IP, set, entry.IP); err != nil {
+		return err
+	}
+	if entry.IPTo != "" {
+		if set.Family == "inet6" {
+			return fmt.Errorf("invalid add command: ip range %s-%s is not supported by inet6 set %s", entry.IP, entry.IPTo, set.Name)
+		}
+		if err := fillIPAddr(parent, IPSET_ATTR_IP_TO, set, entry.IPTo); err != nil {
+			return err
+		}
+	}
+	if entry.CIDR != nil {
+		parent.AddRtAttr(IPSET_ATTR_CIDR, nl.Uint8Attr(*entry.CIDR))
+	}
+	return nil
+}
+
+// fillIPAddr adds the nested ip attr of attrType, the family of ip must match the family of set
+func fillIPAddr(parent *nl.RtAttr, attrType int, set *IPSet, ipStr string) error {
+	ip := net.ParseIP(ipStr)
 	if ip == nil {
-		return fmt.Errorf("invalid add command: bad ip: %s", entry.IP)
+		return fmt.Errorf("invalid add command: bad ip: %s", ipStr)
 	}
-	ipAttr := nl.NewRtAttr(IPSET_ATTR_IP|unix.NLA_F_NESTED, nil)
+	family := set.Family
+	if family == "" {
+		family = "inet"
+	}
+	ipAttr := nl.NewRtAttr(attrType|unix.NLA_F_NESTED, nil)
 	if ip4 := ip.To4(); ip4 != nil {
+		if family != "inet" {
+			return fmt.Errorf("invalid add command: ipv4 address %s in %s set %s", ipStr, family, set.Name)
+		}
 		ipAttr.AddRtAttr(IPSET_ATTR_IPADDR_IPV4|unix.NLA_F_NET_BYTEORDER, []byte(ip4))
-	} else if ip6 := ip.To16(); ip6 != nil {
-		// TODO ip6
+	} else {
+		if family != "inet6" {
+			return fmt.Errorf("invalid add command: ipv6 address %s in %s set %s", ipStr, family, set.Name)
+		}
+		ipAttr.AddRtAttr(IPSET_ATTR_IPADDR_IPV6|unix.NLA_F_NET_BYTEORDER, []byte(ip.To16()))
 	}
 	parent.AddChild(ipAttr)
-	if entry.CIDR != nil {
-		parent.AddRtAttr(IPSET_ATTR_CIDR, nl.Uint8Attr(*entry.CIDR))
-	}
 	return nil
 }
 
-func fillPort(parent *nl.RtAttr, entry *Entry) error {
+func fillPort(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
 	parent.AddRtAttr(IPSET_ATTR_PORT|unix.NLA_F_NET_BYTEORDER, htons(entry.Port))
 	if entry.PortTo != 0 {
 		parent.AddRtAttr(IPSET_ATTR_PORT_TO|unix.NLA_F_NET_BYTEORDER, htons(entry.PortTo))
@@ -442,25 +1226,61 @@ func fillPort(parent *nl.RtAttr, entry *Entry) error {
 	return nil
 }
 
-func fillIP2(parent *nl.RtAttr, entry *Entry) error {
-	ip := net.ParseIP(entry.IP2)
-	if ip == nil {
-		return fmt.Errorf("invalid add command: bad ip: %s", entry.IP2)
+// fillBitmapPort adds port or port range without protocol
+func fillBitmapPort(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	parent.AddRtAttr(IPSET_ATTR_PORT|unix.NLA_F_NET_BYTEORDER, htons(entry.Port))
+	if entry.PortTo != 0 {
+		parent.AddRtAttr(IPSET_ATTR_PORT_TO|unix.NLA_F_NET_BYTEORDER, htons(entry.PortTo))
 	}
-	ipAttr := nl.NewRtAttr(IPSET_ATTR_IP2|unix.NLA_F_NESTED, nil)
-	if ip4 := ip.To4(); ip4 != nil {
-		ipAttr.AddRtAttr(IPSET_ATTR_IPADDR_IPV4|unix.NLA_F_NET_BYTEORDER, []byte(ip4))
-	} else if ip6 := ip.To16(); ip6 != nil {
-		// TODO ip6
+	return nil
+}
+
+func fillMark(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	parent.AddRtAttr(IPSET_ATTR_MARK|unix.NLA_F_NET_BYTEORDER, htonl(entry.Mark))
+	return nil
+}
+
+func fillIface(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	if entry.Iface == "" || len(entry.Iface) >= unix.IFNAMSIZ {
+		return fmt.Errorf("invalid add command: bad iface: %q", entry.Iface)
+	}
+	parent.AddRtAttr(IPSET_ATTR_IFACE, nl.ZeroTerminated(entry.Iface))
+	return nil
+}
+
+func fillName(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	if err := checkSetName("add", entry.Name); err != nil {
+		return err
+	}
+	parent.AddRtAttr(IPSET_ATTR_NAME, nl.ZeroTerminated(entry.Name))
+	if entry.NameRef != "" {
+		if err := checkSetName("add", entry.NameRef); err != nil {
+			return err
+		}
+		parent.AddRtAttr(IPSET_ATTR_NAMEREF, nl.ZeroTerminated(entry.NameRef))
+	}
+	return nil
+}
+
+func fillIP2(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	if err := fillIPAddr(parent, IPSET_ATTR_IP2, set, entry.IP2); err != nil {
+		return err
+	}
+	if entry.IP2To != "" {
+		if set.Family == "inet6" {
+			return fmt.Errorf("invalid add command: ip range %s-%s is not supported by inet6 set %s", entry.IP2, entry.IP2To, set.Name)
+		}
+		if err := fillIPAddr(parent, IPSET_ATTR_IP2_TO, set, entry.IP2To); err != nil {
+			return err
+		}
 	}
-	parent.AddChild(ipAttr)
 	if entry.CIDR2 != nil {
 		parent.AddRtAttr(IPSET_ATTR_CIDR2, nl.Uint8Attr(*entry.CIDR2))
 	}
 	return nil
 }
 
-func fillMac(parent *nl.RtAttr, entry *Entry) error {
+func fillMac(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
 	if len(entry.Mac) == 0 {
 		return fmt.Errorf("invalid add command: bad mac: %v", entry.Mac)
 	}
@@ -468,6 +1288,14 @@ func fillMac(parent *nl.RtAttr, entry *Entry) error {
 	return nil
 }
 
+// fillOptionalMac adds the mac address if it is set
+func fillOptionalMac(parent *nl.RtAttr, set *IPSet, entry *Entry) error {
+	if len(entry.Mac) == 0 {
+		return nil
+	}
+	return fillMac(parent, set, entry)
+}
+
 func (h *Handle) newRequest(cmd int) (*nl.NetlinkRequest, error) {
 	if cmd <= IPSET_CMD_NONE || cmd >= IPSET_MSG_MAX {
 		return nil, fmt.Errorf("cmd should between IPSET_CMD_NONE and IPSET_MSG_MAX")
@@ -478,6 +1306,13 @@ func (h *Handle) newRequest(cmd int) (*nl.NetlinkRequest, error) {
 	return req, nil
 }
 
+var (
+	// ErrSetNameExist is returned by Rename if the new set name is already in use
+	ErrSetNameExist = errors.New("set with the same name already exists")
+	// ErrSetReferenced is returned by Rename if the set is referenced by kernel components
+	ErrSetReferenced = errors.New("set is referenced by kernel components")
+)
+
 // TryConvertErrno tries to convert input err to a IPSETErrno
 // Return the IPSetErrno pointer if it succeeds, otherwise nil
 func TryConvertErrno(err error) *int32 {
@@ -495,6 +1330,23 @@ func TryConvertErrno(err error) *int32 {
 	return nil
 }
 
+func hasOpt(opts []Opt, opt Opt) bool {
+	for i := range opts {
+		if opts[i] == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrno(err error, errno int32) bool {
+	if err == nil {
+		return false
+	}
+	no := TryConvertErrno(err)
+	return no != nil && *no == errno
+}
+
 //buffers: 48 0 0 0 13 6 1 0 125 248 115 92 0 0 0 0 2 0 0 0 5 0 1 0 6 0 0 0 12 0 3 0 104 97 115 104 58 105 112 0 5 0 5 0 2 0 0 0
 //Message header: sent cmd  TYPE (13)
 //len 48
@@ -516,13 +1368,18 @@ func TryConvertErrno(err error) *int32 {
 //FAMILY: 2
 //PROTO_MIN: 0
 func (h *Handle) getRevision(setType SetType) (uint8, uint8, error) {
+	return h.getFamilyRevision(setType, "inet")
+}
+
+// getFamilyRevision returns the max and min revisions of setType of family supported by kernel
+func (h *Handle) getFamilyRevision(setType SetType, family string) (uint8, uint8, error) {
 	req, err := h.newRequest(IPSET_CMD_TYPE)
 	if err != nil {
 		return 0, 0, err
 	}
 	h.l.Debugf("type %v", req.Serialize())
 	req.AddData(nl.NewRtAttr(IPSET_ATTR_TYPENAME, nl.ZeroTerminated(string(setType))))
-	fillFamily(req, "inet")
+	fillFamily(req, family)
 	msgs, err := req.Execute(unix.NETLINK_NETFILTER, 0)
 	if err != nil {
 		return 0, 0, err
@@ -551,6 +1408,37 @@ func (h *Handle) getRevision(setType SetType) (uint8, uint8, error) {
 		}
 		break
 	}
-	h.l.Debugf("supported revision of %v is %d, min supported %d", setType, max, min)
+	h.l.Debugf("supported revision of %v %s is %d, min supported %d", setType, family, max, min)
 	return max, min, nil
 }
+
+// Capabilities probes the ipset protocol versions and the revisions of all set types of inet and inet6 family
+// supported by kernel. Set types which are not supported, e.g. the kernel module is missing, are reported with
+// Supported false.
+func (h *Handle) Capabilities() (*Capabilities, error) {
+	var c Capabilities
+	var err error
+	if c.ProtocolMax, c.ProtocolMin, err = h.protocolRange(); err != nil {
+		return nil, err
+	}
+	for _, setType := range setTypes {
+		for _, family := range []string{"inet", "inet6"} {
+			max, min, err := h.getFamilyRevision(setType, family)
+			if err != nil {
+				if !isErrno(err, IPSET_ERR_FIND_TYPE) {
+					return nil, fmt.Errorf("failed to probe setType %s family %s: %v", setType, family, err)
+				}
+				c.SetTypes = append(c.SetTypes, SetTypeCapability{SetType: setType, Family: family})
+				continue
+			}
+			c.SetTypes = append(c.SetTypes, SetTypeCapability{
+				SetType:     setType,
+				Family:      family,
+				Supported:   true,
+				RevisionMin: min,
+				RevisionMax: max,
+			})
+		}
+	}
+	return &c, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
 	"sort"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"encoding/json"
 	"github.com/chenchun/ipset/log"
+	"github.com/vishvananda/netlink/nl"
 	"golang.org/x/sys/unix"
 )
 
@@ -47,6 +49,37 @@ func allSetType() []SetType {
 	}
 }
 
+func TestCapabilities(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := h.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ProtocolMax < IPSET_PROTOCOL_MIN || c.ProtocolMax > IPSET_PROTOCOL || c.ProtocolMin > c.ProtocolMax {
+		t.Errorf("unexpected protocol min %d max %d", c.ProtocolMin, c.ProtocolMax)
+	}
+	if len(c.SetTypes) != 2*len(allSetType()) {
+		t.Errorf("expect capabilities of all set types of inet and inet6, real %+v", c.SetTypes)
+	}
+	for _, setType := range c.SetTypes {
+		if setType.Supported && setType.RevisionMin > setType.RevisionMax {
+			t.Errorf("unexpected revisions %+v", setType)
+		}
+	}
+	if !c.Supports(HashIP, "inet") || !c.Supports(HashIP, "inet6") {
+		t.Errorf("expect hash:ip supported: %+v", c.SetTypes)
+	}
+	if c.Supports(BitmapIP, "inet6") {
+		t.Error("expect bitmap:ip of inet6 not supported")
+	}
+	if c.Supports(SetType("hash:foo"), "inet") {
+		t.Error("expect hash:foo not supported")
+	}
+}
+
 func TestCreateDestroy(t *testing.T) {
 	h, err := New(&log.Log{})
 	if err != nil {
@@ -112,7 +145,7 @@ func TestList(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(fmt.Sprintf("%+v", sets), `{Name:TestList SetType:hash:ip Family:inet HashSize:0 MaxElem:0 PortRange: Comment: SetRevison:`) {
+	if !strings.Contains(fmt.Sprintf("%+v", sets), `{Name:TestList SetType:hash:ip Family:inet HashSize:1024 MaxElem:65536 PortRange: Comment: SetRevison:`) {
 		t.Errorf(fmt.Sprintf("%+v", sets))
 	}
 	if len(sets) <= 0 {
@@ -162,6 +195,27 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListLargeSet(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestListLargeSet", SetType: HashIP}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	// entries of a large set are split into several netlink msgs
+	for i := 1; i <= 3000; i++ {
+		if err := h.Add(set, &Entry{IP: intToIP4(uint32(i)).String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkEntryNum(h, set.Name, 3000); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestAddDelHashIP(t *testing.T) {
 	h, err := New(&log.Log{})
 	if err != nil {
@@ -189,6 +243,1005 @@ func TestAddDelHashIP(t *testing.T) {
 	}
 }
 
+func TestExist(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestExist", SetType: HashIP}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Create(set); err == nil {
+		t.Error("expect creating existing set error")
+	}
+	if err := h.Create(set, IPSET_OPT_EXIST); err != nil {
+		t.Errorf("create existing set with IPSET_OPT_EXIST: %v", err)
+	}
+	if err := h.Create(&IPSet{Name: set.Name, SetType: HashNet}, IPSET_OPT_EXIST); err == nil {
+		t.Error("expect creating existing set of different type error")
+	}
+	entry := &Entry{IP: "192.168.0.1"}
+	if err := h.Add(set, entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add(set, entry); !isErrno(err, IPSET_ERR_EXIST) {
+		t.Errorf("expect adding existing entry error, real %v", err)
+	}
+	if err := h.Add(set, entry, IPSET_OPT_EXIST); err != nil {
+		t.Errorf("add existing entry with IPSET_OPT_EXIST: %v", err)
+	}
+	if err := h.Del(set, entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Del(set, entry); !isErrno(err, IPSET_ERR_EXIST) {
+		t.Errorf("expect deleting missing entry error, real %v", err)
+	}
+	if err := h.Del(set, entry, IPSET_OPT_EXIST); err != nil {
+		t.Errorf("delete missing entry with IPSET_OPT_EXIST: %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set1 := &IPSet{Name: "TestFlush1", SetType: HashIP}
+	set2 := &IPSet{Name: "TestFlush2", SetType: HashIP}
+	for _, set := range []*IPSet{set1, set2} {
+		if err := h.Create(set); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(set.Name)
+		for _, ip := range []string{"192.168.0.1", "192.168.0.2"} {
+			if err := h.Add(set, &Entry{IP: ip}); err != nil {
+				t.Fatalf("case %s add: %v", set.Name, err)
+			}
+		}
+	}
+	if err := h.Flush(set1.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEntryNum(h, set1.Name, 0); err != nil {
+		t.Error(err)
+	}
+	if err := checkEntryNum(h, set2.Name, 2); err != nil {
+		t.Error(err)
+	}
+	if err := h.Flush(set2.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEntryNum(h, set2.Name, 0); err != nil {
+		t.Error(err)
+	}
+	// FlushAll flushes all sets of the host, including those not created by tests
+	if os.Getenv("IPSET_TEST_FLUSH_ALL") != "" {
+		if err := h.Add(set1, &Entry{IP: "192.168.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.FlushAll(); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEntryNum(h, set1.Name, 0); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := h.Flush(""); err == nil {
+		t.Error("expect missing setname error")
+	}
+	if err := h.Flush(strings.Repeat("a", IPSET_MAXNAMELEN)); err == nil {
+		t.Error("expect too long setname error")
+	}
+	if err := h.Flush("TestFlushNotExist"); err == nil {
+		t.Error("expect flushing not exist set error")
+	}
+}
+
+func TestRename(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"TestRename1", "TestRename2"} {
+		if err := h.Create(&IPSet{Name: name, SetType: HashIP}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer h.Destroy("TestRename2")
+	if err := h.Rename("TestRename1", "TestRename3"); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy("TestRename3")
+	if err := checkEntryNum(h, "TestRename3", 0); err != nil {
+		t.Error(err)
+	}
+	if err := h.Rename("TestRename3", "TestRename2"); err != ErrSetNameExist {
+		t.Errorf("expect %v, real %v", ErrSetNameExist, err)
+	}
+	if err := h.Rename("TestRename1", "TestRename4"); err == nil {
+		t.Error("expect renaming not exist set error")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set1 := &IPSet{Name: "TestSwap1", SetType: HashIP}
+	set2 := &IPSet{Name: "TestSwap2", SetType: HashIP}
+	for _, set := range []*IPSet{set1, set2} {
+		if err := h.Create(set); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(set.Name)
+	}
+	if err := h.Add(set1, &Entry{IP: "192.168.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Swap(set1.Name, set2.Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEntryNum(h, set1.Name, 0); err != nil {
+		t.Error(err)
+	}
+	if err := checkEntryNum(h, set2.Name, 1); err != nil {
+		t.Error(err)
+	}
+	if err := h.Swap(set1.Name, "TestSwapNotExist"); err == nil {
+		t.Error("expect swapping not exist set error")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestReplaceWithAVeryLongName", SetType: HashIP}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Add(set, &Entry{IP: "192.168.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Replace(set, []Entry{{IP: "192.168.0.2"}, {IP: "192.168.0.3"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEntryNum(h, set.Name, 2); err != nil {
+		t.Error(err)
+	}
+	if err := h.Replace(set, []Entry{{IP: "192.168.0.4"}, {IP: "bad ip"}}); err == nil {
+		t.Error("expect replacing with bad entry error")
+	}
+	sets, err := h.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sets {
+		if sets[i].Name != set.Name && strings.HasPrefix(sets[i].Name, "TestReplace") {
+			t.Errorf("temporary set %s is not destroyed", sets[i].Name)
+		}
+		if sets[i].Name == set.Name && len(sets[i].Entries) != 2 {
+			t.Errorf("expect set %s unchanged, real entries %+v", set.Name, sets[i].Entries)
+		}
+	}
+}
+
+func TestTest(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr8 := uint8(8)
+	set := &IPSet{Name: "TestTest", SetType: HashNet}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Add(set, &Entry{IP: "10.0.0.0", CIDR: &cidr8}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		entry  *Entry
+		expect bool
+	}{
+		{entry: &Entry{IP: "10.1.2.3"}, expect: true},
+		{entry: &Entry{IP: "10.0.0.0", CIDR: &cidr8}, expect: true},
+		{entry: &Entry{IP: "192.168.0.1"}, expect: false},
+	} {
+		if in, err := h.Test(set, test.entry); err != nil {
+			t.Errorf("case %+v test: %v", test.entry, err)
+		} else if in != test.expect {
+			t.Errorf("case %+v: expect %v, real %v", test.entry, test.expect, in)
+		}
+	}
+	if _, err := h.Test(&IPSet{Name: "TestTestNotExist", SetType: HashNet}, &Entry{IP: "10.1.2.3"}); err == nil {
+		t.Error("expect testing not exist set error")
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr64 := uint8(64)
+	for _, test := range []struct {
+		set    *IPSet
+		entry  *Entry
+		expect Entry
+	}{
+		{
+			set:    &IPSet{Name: "TestIPv6HashIP", SetType: HashIP, Family: "inet6"},
+			entry:  &Entry{IP: "2001:db8::1"},
+			expect: Entry{IP: "2001:db8::1"},
+		},
+		{
+			set:    &IPSet{Name: "TestIPv6HashNet", SetType: HashNet, Family: "inet6"},
+			entry:  &Entry{IP: "2001:db8::1", CIDR: &cidr64},
+			expect: Entry{IP: "2001:db8::", CIDR: &cidr64},
+		},
+		{
+			set:    &IPSet{Name: "TestIPv6HashIPPortIP", SetType: HashIPPortIP, Family: "inet6"},
+			entry:  &Entry{IP: "2001:db8::1", Port: 80, Proto: unix.IPPROTO_TCP, IP2: "fe80::2"},
+			expect: Entry{IP: "2001:db8::1", Port: 80, Proto: unix.IPPROTO_TCP, IP2: "fe80::2"},
+		},
+	} {
+		if err := h.Create(test.set); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(test.set.Name)
+		if err := h.Add(test.set, test.entry); err != nil {
+			t.Fatalf("set %s: %v", test.set.Name, err)
+		}
+		if err := checkListEntries(h, addDelCase{set: test.set, expectEntries: []Entry{test.expect}}); err != nil {
+			t.Errorf("set %s: %v", test.set.Name, err)
+		}
+		if in, err := h.Test(test.set, test.entry); err != nil || !in {
+			t.Errorf("set %s: expect entry in set, real %v %v", test.set.Name, in, err)
+		}
+		if err := h.Add(test.set, &Entry{IP: "192.168.0.1", IP2: "192.168.0.2", Port: 80}); err == nil {
+			t.Errorf("set %s: expect adding ipv4 entry error", test.set.Name)
+		}
+	}
+	// kernel supports ip ranges of inet sets only
+	for _, entry := range []*Entry{
+		{IP: "2001:db8::1", IPTo: "2001:db8::2", Port: 80, Proto: unix.IPPROTO_TCP, IP2: "fe80::2"},
+		{IP: "2001:db8::1", Port: 80, Proto: unix.IPPROTO_TCP, IP2: "fe80::2", IP2To: "fe80::3"},
+	} {
+		set := &IPSet{Name: "TestIPv6HashIPPortIP", SetType: HashIPPortIP, Family: "inet6"}
+		if err := h.Add(set, entry); err == nil || !strings.HasPrefix(err.Error(), "invalid add command: ip range") {
+			t.Errorf("case %+v: expect ip range error, real %v", entry, err)
+		}
+	}
+	set := &IPSet{Name: "TestIPv6Inet", SetType: HashIP}
+	if err := h.Add(set, &Entry{IP: "2001:db8::1"}); err == nil {
+		t.Error("expect adding ipv6 entry to inet set error")
+	}
+}
+
+func TestIPRange(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr24 := uint8(24)
+	for _, test := range []struct {
+		set    *IPSet
+		entry  *Entry
+		expect int
+	}{
+		{set: &IPSet{Name: "TestIPRangeHashIP", SetType: HashIP}, entry: &Entry{IP: "10.0.0.0", IPTo: "10.0.255.255"}, expect: 65536},
+		{set: &IPSet{Name: "TestIPRangeHashNet", SetType: HashNet}, entry: &Entry{IP: "10.0.0.0", IPTo: "10.0.3.255", CIDR: &cidr24}, expect: 1},
+		{set: &IPSet{Name: "TestIPRangeHashIPPort", SetType: HashIPPort}, entry: &Entry{IP: "10.0.0.1", IPTo: "10.0.0.4", Port: 80, PortTo: 81}, expect: 8},
+		{set: &IPSet{Name: "TestIPRangeHashIPPortNet", SetType: HashIPPortNet}, entry: &Entry{IP: "10.0.0.1", IPTo: "10.0.0.2", Port: 80, IP2: "10.1.0.0", IP2To: "10.1.1.255"}, expect: 2},
+	} {
+		if err := h.Create(test.set); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(test.set.Name)
+		if err := h.Add(test.set, test.entry); err != nil {
+			t.Fatalf("set %s: %v", test.set.Name, err)
+		}
+		if err := checkEntryNum(h, test.set.Name, test.expect); err != nil {
+			t.Errorf("set %s: %v", test.set.Name, err)
+		}
+		if err := h.Del(test.set, test.entry); err != nil {
+			t.Fatalf("set %s: %v", test.set.Name, err)
+		}
+		if err := checkEntryNum(h, test.set.Name, 0); err != nil {
+			t.Errorf("set %s: %v", test.set.Name, err)
+		}
+	}
+}
+
+func TestBitmapIP(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(&IPSet{Name: "TestBitmapIPRange", SetType: HashIP, IPRange: "10.0.0.0/16"}); err == nil {
+		t.Error("expect creating hash:ip with range error")
+	}
+	set := &IPSet{Name: "TestBitmapIP", SetType: BitmapIP, IPRange: "10.0.0.0/16", Netmask: 24}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	for _, entry := range []*Entry{{IP: "10.0.1.1"}, {IP: "10.0.2.0", IPTo: "10.0.4.255"}} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Add(set, &Entry{IP: "10.1.0.1"}); err == nil {
+		t.Error("expect adding ip out of range error")
+	}
+	if err := h.Del(set, &Entry{IP: "10.0.4.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: []Entry{{IP: "10.0.1.0"}, {IP: "10.0.2.0"}, {IP: "10.0.3.0"}}}); err != nil {
+		t.Error(err)
+	}
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.IPRange != "10.0.0.0-10.0.255.255" || header.Netmask != 24 {
+		t.Errorf("expect range 10.0.0.0-10.0.255.255 netmask 24, real %+v", header.IPSet)
+	}
+}
+
+func TestBitmapIPMac(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := net.ParseMAC("01:23:45:67:89:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMac, err := net.ParseMAC("01:23:45:67:89:ac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestBitmapIPMac", SetType: BitmapIPMac, IPRange: "192.168.0.0-192.168.0.255"}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	for _, entry := range []*Entry{{IP: "192.168.0.1", Mac: mac}, {IP: "192.168.0.2"}, {IP: "192.168.0.3"}} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Del(set, &Entry{IP: "192.168.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: []Entry{{IP: "192.168.0.1", Mac: mac}, {IP: "192.168.0.2"}}}); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []struct {
+		entry  *Entry
+		expect bool
+	}{
+		{entry: &Entry{IP: "192.168.0.1"}, expect: true},
+		{entry: &Entry{IP: "192.168.0.1", Mac: mac}, expect: true},
+		{entry: &Entry{IP: "192.168.0.1", Mac: otherMac}, expect: false},
+		{entry: &Entry{IP: "192.168.0.2"}, expect: true},
+		{entry: &Entry{IP: "192.168.0.3"}, expect: false},
+	} {
+		if in, err := h.Test(set, test.entry); err != nil {
+			t.Errorf("case %+v test: %v", test.entry, err)
+		} else if in != test.expect {
+			t.Errorf("case %+v: expect %v, real %v", test.entry, test.expect, in)
+		}
+	}
+}
+
+func TestBitmapPort(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Create(&IPSet{Name: "TestBitmapPortRange", SetType: BitmapPort, PortRange: "1024"}); err == nil {
+		t.Error("expect creating bitmap:port with single port error")
+	}
+	set := &IPSet{Name: "TestBitmapPort", SetType: BitmapPort, PortRange: "0-1024"}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	for _, entry := range []*Entry{{Port: 22}, {Port: 80, PortTo: 82}} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Add(set, &Entry{Port: 8080}); err == nil {
+		t.Error("expect adding port out of range error")
+	}
+	if err := h.Del(set, &Entry{Port: 81}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: []Entry{{Port: 22}, {Port: 80}, {Port: 82}}}); err != nil {
+		t.Error(err)
+	}
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.PortRange != "0-1024" {
+		t.Errorf("expect port range 0-1024, real %+v", header.IPSet)
+	}
+}
+
+func TestHashIPMark(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestHashIPMark", SetType: HashIPMark, MarkMask: 0xff00}
+	if err := h.Create(set); err != nil {
+		if isErrno(err, IPSET_ERR_FIND_TYPE) {
+			t.Skipf("skip testing setType %s: %v", set.SetType, err)
+		}
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Add(set, &Entry{IP: "192.168.0.1", Mark: 0x1234}); err != nil {
+		t.Fatal(err)
+	}
+	// kernel stores mark & markmask
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: []Entry{{IP: "192.168.0.1", Mark: 0x1200}}}); err != nil {
+		t.Error(err)
+	}
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.MarkMask != 0xff00 {
+		t.Errorf("expect markmask 0xff00, real %+v", header.IPSet)
+	}
+}
+
+func TestParseCreateDataMarkMask(t *testing.T) {
+	for _, attr := range []*nl.RtAttr{
+		nl.NewRtAttr(IPSET_ATTR_MARKMASK, nl.Uint32Attr(0xff00)),
+		nl.NewRtAttr(IPSET_ATTR_MARKMASK|unix.NLA_F_NET_BYTEORDER, htonl(0xff00)),
+	} {
+		var item ListItem
+		if err := parseCreateData(&item, attr.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+		if item.MarkMask != 0xff00 {
+			t.Errorf("attr type %d: expect markmask 0xff00, real 0x%x", attr.Type, item.MarkMask)
+		}
+	}
+}
+
+func TestHashNetIface(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr24 := uint8(24)
+	set := &IPSet{Name: "TestHashNetIface", SetType: HashNetIface}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	entries := []Entry{
+		{IP: "192.168.0.0", CIDR: &cidr24, Iface: "eth0"},
+		{IP: "192.168.1.0", CIDR: &cidr24, Iface: "eth1", PhysDev: true},
+		{IP: "192.168.2.0", CIDR: &cidr24, Iface: "veth", Wildcard: true},
+	}
+	for i := range entries {
+		if err := h.Add(set, &entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: entries}); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []struct {
+		entry  *Entry
+		expect bool
+	}{
+		{entry: &Entry{IP: "192.168.0.1", Iface: "eth0"}, expect: true},
+		{entry: &Entry{IP: "192.168.0.1", Iface: "eth1"}, expect: false},
+		{entry: &Entry{IP: "192.168.1.1", Iface: "eth1", PhysDev: true}, expect: true},
+		{entry: &Entry{IP: "192.168.1.1", Iface: "eth1"}, expect: false},
+	} {
+		if in, err := h.Test(set, test.entry); err != nil {
+			t.Errorf("case %+v test: %v", test.entry, err)
+		} else if in != test.expect {
+			t.Errorf("case %+v: expect %v, real %v", test.entry, test.expect, in)
+		}
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.0", CIDR: &cidr24}); err == nil {
+		t.Error("expect adding entry without iface error")
+	}
+	if err := h.Add(&IPSet{Name: set.Name, SetType: HashNet}, &Entry{IP: "192.168.0.0", PhysDev: true}); err == nil {
+		t.Error("expect adding physdev entry to hash:net error")
+	}
+}
+
+func TestListSet(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := []string{"TestListSetA", "TestListSetB", "TestListSetC"}
+	for _, name := range members {
+		if err := h.Create(&IPSet{Name: name, SetType: HashIP}); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(name)
+	}
+	set := &IPSet{Name: "TestListSet", SetType: ListSet}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	for _, entry := range []*Entry{
+		{Name: "TestListSetC"},
+		{Name: "TestListSetA", NameRef: "TestListSetC", Before: true},
+		{Name: "TestListSetB", NameRef: "TestListSetA"},
+	} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatalf("case %+v add: %v", entry, err)
+		}
+	}
+	if err := h.Add(set, &Entry{Name: "TestListSetNotExist"}); err == nil {
+		t.Error("expect adding not exist set error")
+	}
+	if err := h.Add(set, &Entry{Name: "TestListSetA", Before: true}); err == nil {
+		t.Error("expect adding before without reference set error")
+	}
+	checkMembers := func(expect []string) {
+		items, err := h.List(set.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var real []string
+		for _, entry := range items[0].Entries {
+			real = append(real, entry.Name)
+		}
+		if strings.Join(real, ",") != strings.Join(expect, ",") {
+			t.Errorf("expect members %v, real %v", expect, real)
+		}
+	}
+	// kernel keeps the order of members
+	checkMembers(members)
+	for _, test := range []struct {
+		entry  *Entry
+		expect bool
+	}{
+		{entry: &Entry{Name: "TestListSetA"}, expect: true},
+		{entry: &Entry{Name: "TestListSetA", NameRef: "TestListSetB", Before: true}, expect: true},
+		{entry: &Entry{Name: "TestListSetA", NameRef: "TestListSetC", Before: true}, expect: false},
+		{entry: &Entry{Name: "TestListSetC", NameRef: "TestListSetB"}, expect: true},
+	} {
+		if in, err := h.Test(set, test.entry); err != nil {
+			t.Errorf("case %+v test: %v", test.entry, err)
+		} else if in != test.expect {
+			t.Errorf("case %+v: expect %v, real %v", test.entry, test.expect, in)
+		}
+	}
+	if err := h.Del(set, &Entry{Name: "TestListSetB", NameRef: "TestListSetC", Before: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkMembers([]string{"TestListSetA", "TestListSetC"})
+}
+
+func TestHashCreateOptions(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initVal := uint32(0x1234)
+	set := &IPSet{Name: "TestHashCreateOptions", SetType: HashIP, Netmask: 24, BucketSize: 4, InitVal: &initVal}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Netmask != 24 || header.BucketSize != 4 || header.InitVal == nil || *header.InitVal != initVal {
+		t.Errorf("expect netmask 24 bucketsize 4 initval 0x1234, real %+v", header.IPSet)
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: []Entry{{IP: "192.168.0.0"}}}); err != nil {
+		t.Error(err)
+	}
+	oldRevision := bucketSizeRevisions[HashIP] - 1
+	oldSet := &IPSet{Name: "TestHashCreateOptionsOld", SetType: HashIP, SetRevison: &oldRevision, Probes: 4, Resize: 50,
+		Netmask: 24}
+	if err := h.Create(oldSet); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(oldSet.Name)
+	for _, test := range []*IPSet{
+		{Name: "TestHashCreateOptions1", SetType: HashIP, SetRevison: &oldRevision, BucketSize: 4},
+		{Name: "TestHashCreateOptions2", SetType: HashIP, Probes: 4},
+		{Name: "TestHashCreateOptions3", SetType: HashNet, Netmask: 24},
+		{Name: "TestHashCreateOptions4", SetType: ListSet, BucketSize: 4},
+	} {
+		if err := h.Create(test); err == nil {
+			h.Destroy(test.Name)
+			t.Errorf("case %+v: expect create error", test)
+		} else if !strings.HasPrefix(err.Error(), "invalid create command: ") {
+			t.Errorf("case %+v: expect invalid create command error, real %v", test, err)
+		}
+	}
+	// hash:net,net supports netmask since revision 4
+	req := nl.NewNetlinkRequest(IPSET_CMD_CREATE|(NFNL_SUBSYS_IPSET<<8), 0)
+	if err := fillCreateData(req, &IPSet{SetType: HashNetNet, Netmask: 24}, 3); err == nil {
+		t.Error("expect netmask of hash:net,net revision 3 error")
+	}
+	if err := fillCreateData(req, &IPSet{SetType: HashNetNet, Netmask: 24}, 4); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNoMatch(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr8, cidr16 := uint8(8), uint8(16)
+	set := &IPSet{Name: "TestNoMatch", SetType: HashNet}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	entries := []Entry{{IP: "10.0.0.0", CIDR: &cidr8}, {IP: "10.1.0.0", CIDR: &cidr16, NoMatch: true}}
+	for i := range entries {
+		if err := h.Add(set, &entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: entries}); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []struct {
+		entry  *Entry
+		expect TestResult
+	}{
+		{entry: &Entry{IP: "10.2.0.1"}, expect: TestResultIn},
+		{entry: &Entry{IP: "10.1.0.1"}, expect: TestResultNoMatch},
+		{entry: &Entry{IP: "10.1.0.1", NoMatch: true}, expect: TestResultIn},
+		{entry: &Entry{IP: "10.2.0.1", NoMatch: true}, expect: TestResultNotIn},
+		{entry: &Entry{IP: "11.0.0.1"}, expect: TestResultNotIn},
+	} {
+		result, err := h.TestEntry(set, test.entry)
+		if err != nil {
+			t.Errorf("case %+v: %v", test.entry, err)
+		} else if result != test.expect {
+			t.Errorf("case %+v: expect %v, real %v", test.entry, test.expect, result)
+		}
+		if in, err := h.Test(set, test.entry); err != nil {
+			t.Errorf("case %+v: %v", test.entry, err)
+		} else if in != (test.expect == TestResultIn) {
+			t.Errorf("case %+v: expect in %v, real %v", test.entry, test.expect == TestResultIn, in)
+		}
+	}
+	if err := h.Add(&IPSet{Name: set.Name, SetType: HashIP}, &Entry{IP: "10.1.0.1", NoMatch: true}); err == nil {
+		t.Error("expect adding nomatch entry to hash:ip error")
+	}
+}
+
+func TestHashSizeMaxElem(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestHashSizeMaxElem", SetType: HashIP, HashSize: 4096, MaxElem: 2}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.HashSize != 4096 || header.MaxElem != 2 {
+		t.Errorf("expect hashsize 4096 maxelem 2, real %+v", header.IPSet)
+	}
+	for _, ip := range []string{"192.168.0.1", "192.168.0.2"} {
+		if err := h.Add(set, &Entry{IP: ip}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.3"}); err == nil {
+		t.Error("expect adding entry to full set error")
+	}
+	for _, test := range []*IPSet{
+		{Name: "TestHashSizeMaxElem1", SetType: BitmapPort, PortRange: "0-1024", MaxElem: 2},
+		{Name: "TestHashSizeMaxElem2", SetType: HashIP, HashSize: -1},
+	} {
+		if err := h.Create(test); err == nil {
+			h.Destroy(test.Name)
+			t.Errorf("case %+v: expect create error", test)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, permanent, short := uint32(300), uint32(0), uint32(10)
+	set := &IPSet{Name: "TestTimeout", SetType: HashIP, Timeout: &timeout}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Timeout == nil || *header.Timeout != timeout {
+		t.Errorf("expect timeout 300, real %+v", header.IPSet)
+	}
+	for _, entry := range []*Entry{
+		{IP: "192.168.0.1"},
+		{IP: "192.168.0.2", Timeout: &permanent},
+		{IP: "192.168.0.3", Timeout: &short},
+	} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	items, err := h.List(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string][2]uint32{"192.168.0.1": {290, 300}, "192.168.0.2": {0, 0}, "192.168.0.3": {1, 10}}
+	if len(items[0].Entries) != len(expect) {
+		t.Fatalf("expect %d entries, real %+v", len(expect), items[0].Entries)
+	}
+	for _, entry := range items[0].Entries {
+		if entry.Timeout == nil || *entry.Timeout < expect[entry.IP][0] || *entry.Timeout > expect[entry.IP][1] {
+			t.Errorf("expect entry %s timeout in %v, real %v", entry.IP, expect[entry.IP], entry.Timeout)
+		}
+	}
+	noTimeoutSet := &IPSet{Name: "TestTimeoutNoTimeout", SetType: HashIP}
+	if err := h.Create(noTimeoutSet); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(noTimeoutSet.Name)
+	if err := h.Add(noTimeoutSet, &Entry{IP: "192.168.0.1", Timeout: &short}); err == nil {
+		t.Error("expect adding entry with timeout to set without timeout support error")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr24 := uint8(24)
+	packets, nbytes, zero := uint64(10), uint64(1)<<40, uint64(0)
+	set := &IPSet{Name: "TestCounters", SetType: HashNet, WithCounters: true}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.WithCounters {
+		t.Errorf("expect set with counters, real %+v", header)
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.0", CIDR: &cidr24, Packets: &packets, Bytes: &nbytes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.1.0", CIDR: &cidr24}); err != nil {
+		t.Fatal(err)
+	}
+	expect := []Entry{
+		{IP: "192.168.0.0", CIDR: &cidr24, Packets: &packets, Bytes: &nbytes},
+		{IP: "192.168.1.0", CIDR: &cidr24, Packets: &zero, Bytes: &zero},
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: expect}); err != nil {
+		t.Error(err)
+	}
+	noCounterSet := &IPSet{Name: "TestCountersNoCounter", SetType: HashNet}
+	if err := h.Create(noCounterSet); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(noCounterSet.Name)
+	if err := h.Add(noCounterSet, &Entry{IP: "192.168.0.0", CIDR: &cidr24, Packets: &packets}); err == nil {
+		t.Error("expect adding entry with counters to set without counters error")
+	}
+}
+
+func TestParseAdtAttrPad(t *testing.T) {
+	packets := uint64(10)
+	data := nl.NewRtAttr(IPSET_ATTR_DATA|unix.NLA_F_NESTED, nil)
+	data.AddRtAttr(IPSET_ATTR_PAD, nil)
+	data.AddRtAttr(IPSET_ATTR_PACKETS|unix.NLA_F_NET_BYTEORDER, htonll(packets))
+	entries, err := parseAdtAttr(data.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Packets == nil || *entries[0].Packets != packets {
+		t.Errorf("expect an entry with packets %d, real %+v", packets, entries)
+	}
+}
+
+func TestComment(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestComment", SetType: HashIP, WithComment: true}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.WithComment {
+		t.Errorf("expect set with comment, real %+v", header)
+	}
+	entries := []Entry{{IP: "192.168.0.1", Comment: "ticket 1 from feed A"}, {IP: "192.168.0.2"}}
+	for i := range entries {
+		if err := h.Add(set, &entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: entries}); err != nil {
+		t.Error(err)
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.3", Comment: strings.Repeat("a", IPSET_MAX_COMMENT_SIZE)}); err != nil {
+		t.Error(err)
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.4", Comment: strings.Repeat("a", IPSET_MAX_COMMENT_SIZE+1)}); err == nil {
+		t.Error("expect adding entry with too long comment error")
+	}
+	if err := h.Add(set, &Entry{IP: "192.168.0.5", Comment: `ticket "2"`}); err == nil {
+		t.Error("expect adding entry with comment containing quotes error")
+	}
+}
+
+func TestSkbInfo(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestSkbInfo", SetType: HashIP, WithSkbInfo: true}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.WithSkbInfo {
+		t.Errorf("expect set with skbinfo, real %+v", header)
+	}
+	for _, entry := range []*Entry{
+		{IP: "192.168.0.1", SkbMark: 0x10},
+		{IP: "192.168.0.2", SkbMark: 0x20, SkbMarkMask: 0xff, SkbPrio: 1<<16 | 2, SkbQueue: 3},
+		{IP: "192.168.0.3"},
+	} {
+		if err := h.Add(set, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []Entry{
+		{IP: "192.168.0.1", SkbMark: 0x10, SkbMarkMask: 0xffffffff},
+		{IP: "192.168.0.2", SkbMark: 0x20, SkbMarkMask: 0xff, SkbPrio: 1<<16 | 2, SkbQueue: 3},
+		{IP: "192.168.0.3"},
+	}
+	if err := checkListEntries(h, addDelCase{set: set, expectEntries: expect}); err != nil {
+		t.Error(err)
+	}
+	noSkbInfoSet := &IPSet{Name: "TestSkbInfoNoSkbInfo", SetType: HashIP}
+	if err := h.Create(noSkbInfoSet); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(noSkbInfoSet.Name)
+	if err := h.Add(noSkbInfoSet, &Entry{IP: "192.168.0.1", SkbQueue: 3}); err == nil {
+		t.Error("expect adding entry with skbinfo to set without skbinfo error")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestHeader", SetType: HashIP}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Add(set, &Entry{IP: "192.168.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	header, err := h.Header(set.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Name != set.Name || header.SetType != set.SetType || header.Family != set.Family || header.SetRevison == nil {
+		t.Errorf("expect header of %+v, real %+v", set, header)
+	}
+	if header.HashSize != 1024 || header.MaxElem != 65536 || header.MemSize == 0 || header.Timeout != nil {
+		t.Errorf("unexpected create data %+v", header)
+	}
+	if len(header.Entries) != 0 || header.Elements != 1 {
+		t.Errorf("expect no entries and 1 element, real %+v", header)
+	}
+	if _, err := h.Header("TestHeaderNotExist"); err == nil {
+		t.Error("expect header of not exist set error")
+	}
+}
+
+func TestGetByNameIndex(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []*IPSet{
+		{Name: "TestGetByName1", SetType: HashIP, Family: "inet"},
+		{Name: "TestGetByName2", SetType: HashIP, Family: "inet6"},
+	} {
+		if err := h.Create(set); err != nil {
+			t.Fatal(err)
+		}
+		defer h.Destroy(set.Name)
+		byName, err := h.GetByName(set.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byName.Name != set.Name || byName.Family != set.Family {
+			t.Errorf("expect name %s family %s, real %+v", set.Name, set.Family, byName)
+		}
+		byIndex, err := h.GetByIndex(byName.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *byIndex != *byName {
+			t.Errorf("expect %+v, real %+v", byName, byIndex)
+		}
+	}
+	if _, err := h.GetByName("TestGetByNameNotExist"); err == nil {
+		t.Error("expect getting not exist set error")
+	}
+	if _, err := h.GetByIndex(IPSET_INVALID_ID); err == nil {
+		t.Error("expect getting invalid index error")
+	}
+}
+
+func checkEntryNum(h *Handle, setName string, expect int) error {
+	items, err := h.List(setName)
+	if err != nil {
+		return err
+	}
+	if len(items) != 1 {
+		return fmt.Errorf("expect 1 set %s, real %+v", setName, items)
+	}
+	if len(items[0].Entries) != expect {
+		return fmt.Errorf("expect %d entries in set %s, real %+v", expect, setName, items[0].Entries)
+	}
+	return nil
+}
+
 func listMembers(set string) ([]string, error) {
 	data, err := exec.Command("ipset", "list", set).CombinedOutput()
 	if err != nil {
@@ -14,6 +14,12 @@ func htonl(val uint32) []byte {
 	return bytes
 }
 
+func htonll(val uint64) []byte {
+	bytes := make([]byte, 8)
+	networkOrder.PutUint64(bytes, val)
+	return bytes
+}
+
 func htons(val uint16) []byte {
 	bytes := make([]byte, 2)
 	networkOrder.PutUint16(bytes, val)
@@ -24,6 +30,10 @@ func ntohl(buf []byte) uint32 {
 	return networkOrder.Uint32(buf)
 }
 
+func ntohll(buf []byte) uint64 {
+	return networkOrder.Uint64(buf)
+}
+
 func ntohs(buf []byte) uint16 {
 	return networkOrder.Uint16(buf)
 }
@@ -0,0 +1,686 @@
+package ipset
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+)
+
+// Restore reads commands in the format of `ipset save` from r and executes them line by line as `ipset restore`
+// does. Supported commands are create, add, del, flush, destroy, rename and swap. Empty lines and lines starting
+// with # are skipped. Passing IPSET_OPT_EXIST in opts applies -exist to all lines, otherwise -exist or -! can be
+// given in a line. Errors are prefixed with the line number of the failed command.
+func (h *Handle) Restore(r io.Reader, opts ...Opt) error {
+	rs := &restorer{h: h, sets: map[string]*IPSet{}, exist: hasOpt(opts, IPSET_OPT_EXIST)}
+	scanner := bufio.NewScanner(r)
+	var lineno uint32
+	for scanner.Scan() {
+		lineno++
+		if err := rs.restoreLine(scanner.Text(), lineno); err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+type restorer struct {
+	h *Handle
+	// sets caches headers of sets created or referred by previous lines
+	sets  map[string]*IPSet
+	exist bool
+}
+
+func (r *restorer) restoreLine(line string, lineno uint32) error {
+	args, err := splitLine(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+		return nil
+	}
+	exist := r.exist
+	var cmdArgs []string
+	for _, arg := range args {
+		if arg == "-exist" || arg == "-!" {
+			exist = true
+		} else {
+			cmdArgs = append(cmdArgs, arg)
+		}
+	}
+	if len(cmdArgs) == 0 {
+		return fmt.Errorf("missing command")
+	}
+	var opts []Opt
+	if exist {
+		opts = append(opts, IPSET_OPT_EXIST)
+	}
+	cmd, args := cmdArgs[0], cmdArgs[1:]
+	switch cmd {
+	case "create":
+		if len(args) < 2 {
+			return fmt.Errorf("invalid create command: missing setname or settype")
+		}
+		set := &IPSet{Name: args[0], SetType: SetType(args[1])}
+		if err := parseCreateOptions(set, args[2:]); err != nil {
+			return err
+		}
+		if err := r.h.Create(set, opts...); err != nil {
+			return err
+		}
+		r.sets[set.Name] = set
+	case "add", "del":
+		if len(args) < 2 {
+			return fmt.Errorf("invalid %s command: missing setname or entry", cmd)
+		}
+		set, err := r.set(args[0])
+		if err != nil {
+			return err
+		}
+		entry, err := parseEntry(set, args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		command := IPSET_CMD_ADD
+		if cmd == "del" {
+			command = IPSET_CMD_DEL
+		}
+		if err := r.h.adt(command, set, entry, 0, lineno, opts...); err != nil {
+			return adtError(cmd, err)
+		}
+	case "flush":
+		if len(args) > 1 {
+			return fmt.Errorf("invalid flush command: too many args %v", args)
+		}
+		if len(args) == 0 {
+			return r.h.FlushAll(opts...)
+		}
+		return r.h.Flush(args[0], opts...)
+	case "destroy":
+		if len(args) > 1 {
+			return fmt.Errorf("invalid destroy command: too many args %v", args)
+		}
+		if len(args) == 0 {
+			r.sets = map[string]*IPSet{}
+			return r.h.DestroyAll(opts...)
+		}
+		delete(r.sets, args[0])
+		return r.h.Destroy(args[0], opts...)
+	case "rename", "swap":
+		if len(args) != 2 {
+			return fmt.Errorf("invalid %s command: expect two setnames, real %v", cmd, args)
+		}
+		delete(r.sets, args[0])
+		delete(r.sets, args[1])
+		if cmd == "rename" {
+			return r.h.Rename(args[0], args[1], opts...)
+		}
+		return r.h.Swap(args[0], args[1], opts...)
+	default:
+		return fmt.Errorf("unknown command %s", cmd)
+	}
+	return nil
+}
+
+// set returns the cached set header or gets it from kernel
+func (r *restorer) set(setName string) (*IPSet, error) {
+	if set, ok := r.sets[setName]; ok {
+		return set, nil
+	}
+	header, err := r.h.Header(setName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get header of set %s: %v", setName, err)
+	}
+	r.sets[setName] = &header.IPSet
+	return &header.IPSet, nil
+}
+
+// splitLine splits line into args separated by whitespaces. Double quoted parts of an arg may contain whitespaces,
+// the quotes are kept in the arg.
+func splitLine(line string) ([]string, error) {
+	var (
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		inQuote bool
+	)
+	for _, c := range line {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+			arg.WriteRune(c)
+		case !inQuote && unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			arg.WriteRune(c)
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// adtErrMessages are the messages of errnos of add and del commands, check ipset/lib/errcode.c
+var adtErrMessages = map[int32]string{
+	IPSET_ERR_INVALID_CIDR:    "the value of the CIDR parameter of the IP address is invalid",
+	IPSET_ERR_INVALID_FAMILY:  "protocol family not supported by the set type",
+	IPSET_ERR_TIMEOUT:         "timeout cannot be used: set was created without timeout support",
+	IPSET_ERR_IPADDR_IPV4:     "an IPv4 address is expected",
+	IPSET_ERR_IPADDR_IPV6:     "an IPv6 address is expected",
+	IPSET_ERR_COUNTER:         "packet/byte counters cannot be used: set was created without counter support",
+	IPSET_ERR_COMMENT:         "comment cannot be used: set was created without comment support",
+	IPSET_ERR_SKBINFO:         "skbinfo mapping cannot be used: set was created without skbinfo support",
+	IPSET_ERR_TYPE_MISMATCH:   "the set type does not match",
+	IPSET_ERR_INVALID_NETMASK: "the value of the netmask parameter is invalid",
+}
+
+// adtError converts the errno of add or del cmd to a readable error
+func adtError(cmd string, err error) error {
+	errno := TryConvertErrno(err)
+	if errno == nil {
+		return err
+	}
+	if *errno == IPSET_ERR_EXIST {
+		if cmd == "add" {
+			return errors.New("element already exists")
+		}
+		return errors.New("element does not exist")
+	}
+	if msg, ok := adtErrMessages[*errno]; ok {
+		return errors.New(msg)
+	}
+	return err
+}
+
+func parseCreateOptions(set *IPSet, args []string) error {
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		value := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value of create option %s", opt)
+			}
+			i++
+			return args[i], nil
+		}
+		switch opt {
+		case "family":
+			family, err := value()
+			if err != nil {
+				return err
+			}
+			if family != "inet" && family != "inet6" {
+				return fmt.Errorf("invalid family %s", family)
+			}
+			set.Family = family
+		case "hashsize", "maxelem":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %v", opt, v, err)
+			}
+			if opt == "hashsize" {
+				set.HashSize = int(n)
+			} else {
+				set.MaxElem = int(n)
+			}
+		case "range":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			if set.SetType == BitmapPort {
+				set.PortRange = v
+			} else {
+				set.IPRange = v
+			}
+		case "netmask", "probes", "resize", "bucketsize":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %v", opt, v, err)
+			}
+			switch opt {
+			case "netmask":
+				set.Netmask = uint8(n)
+			case "probes":
+				set.Probes = uint8(n)
+			case "resize":
+				set.Resize = uint8(n)
+			case "bucketsize":
+				set.BucketSize = uint8(n)
+			}
+		case "initval":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			initval, err := strconv.ParseUint(v, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid initval %s: %v", v, err)
+			}
+			initVal := uint32(initval)
+			set.InitVal = &initVal
+		case "markmask":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			markmask, err := strconv.ParseUint(v, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid markmask %s: %v", v, err)
+			}
+			set.MarkMask = uint32(markmask)
+		case "size":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			size, err := parseUint32(v)
+			if err != nil {
+				return fmt.Errorf("invalid size %s: %v", v, err)
+			}
+			set.Size = size
+		case "timeout":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			timeout, err := parseUint32(v)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %s: %v", v, err)
+			}
+			set.Timeout = &timeout
+		case "counters":
+			set.WithCounters = true
+		case "comment":
+			set.WithComment = true
+		case "skbinfo":
+			set.WithSkbInfo = true
+		case "forceadd":
+			set.WithForceAdd = true
+		default:
+			return fmt.Errorf("create option %s not supported now", opt)
+		}
+	}
+	return nil
+}
+
+type parseEntryFunc func(entry *Entry, part string) error
+
+var setTypeParseFuncMap = map[SetType][]parseEntryFunc{
+	HashIP:         {parseIPPart},
+	BitmapIP:       {parseIPPart},
+	BitmapIPMac:    {parseIPPart, parseMacPart},
+	BitmapPort:     {parseBitmapPortPart},
+	HashMac:        {parseMacPart},
+	HashIPMac:      {parseIPPart, parseMacPart},
+	HashNet:        {parseIPPart},
+	HashNetNet:     {parseIPPart, parseIP2Part},
+	HashIPPort:     {parseIPPart, parsePortPart},
+	HashNetPort:    {parseIPPart, parsePortPart},
+	HashIPPortIP:   {parseIPPart, parsePortPart, parseIP2Part},
+	HashIPPortNet:  {parseIPPart, parsePortPart, parseIP2Part},
+	HashNetPortNet: {parseIPPart, parsePortPart, parseIP2Part},
+	HashIPMark:     {parseIPPart, parseMarkPart},
+	HashNetIface:   {parseIPPart, parseIfacePart},
+	ListSet:        {parseNamePart},
+}
+
+// optionalLastPart are the set types whose last part of entries is optional, e.g. mac of bitmap:ip,mac
+var optionalLastPart = map[SetType]bool{
+	BitmapIPMac: true,
+}
+
+// parseEntry parses entry in the format of `ipset save`, e.g. 192.168.0.1,tcp:80, and the options following it
+func parseEntry(set *IPSet, elem string, opts []string) (*Entry, error) {
+	funcs, exist := setTypeParseFuncMap[set.SetType]
+	if !exist {
+		return nil, fmt.Errorf("restoring entries for setType %s not supported now", set.SetType)
+	}
+	parts := strings.Split(elem, ",")
+	if len(parts) != len(funcs) && !(len(parts) == len(funcs)-1 && optionalLastPart[set.SetType]) {
+		return nil, fmt.Errorf("invalid entry %s for setType %s", elem, set.SetType)
+	}
+	entry := &Entry{}
+	for i := range parts {
+		if err := funcs[i](entry, parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseEntryOptions(entry, opts); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func parseEntryOptions(entry *Entry, opts []string) error {
+	for i := 0; i < len(opts); i++ {
+		opt := opts[i]
+		value := func() (string, error) {
+			if i+1 >= len(opts) {
+				return "", fmt.Errorf("missing value of entry option %s", opt)
+			}
+			i++
+			return opts[i], nil
+		}
+		switch opt {
+		case "before", "after":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			entry.Before, entry.NameRef = opt == "before", v
+		case "timeout":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			timeout, err := parseUint32(v)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %s: %v", v, err)
+			}
+			entry.Timeout = &timeout
+		case "packets", "bytes":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			counter, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %s: %v", opt, v, err)
+			}
+			if opt == "packets" {
+				entry.Packets = &counter
+			} else {
+				entry.Bytes = &counter
+			}
+		case "comment":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+				return fmt.Errorf("comment %s is not double quoted", v)
+			}
+			entry.Comment = v[1 : len(v)-1]
+		case "skbmark":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			if entry.SkbMark, entry.SkbMarkMask, err = parseSkbMark(v); err != nil {
+				return err
+			}
+		case "skbprio":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			if entry.SkbPrio, err = parseSkbPrio(v); err != nil {
+				return err
+			}
+		case "skbqueue":
+			v, err := value()
+			if err != nil {
+				return err
+			}
+			if entry.SkbQueue, err = parseUint16(v); err != nil {
+				return fmt.Errorf("invalid skbqueue %s: %v", v, err)
+			}
+		case "nomatch":
+			entry.NoMatch = true
+		case "wildcard":
+			entry.Wildcard = true
+		default:
+			return fmt.Errorf("entry option %s not supported now", opt)
+		}
+	}
+	return nil
+}
+
+func parseIPPart(entry *Entry, part string) error {
+	if from, to, ok, err := parseIPRange(part); ok {
+		entry.IP, entry.IPTo = from, to
+		return err
+	}
+	ip, cidr, err := parseCIDR(part)
+	if err != nil {
+		return err
+	}
+	entry.IP, entry.CIDR = ip, cidr
+	return nil
+}
+
+func parseIP2Part(entry *Entry, part string) error {
+	if from, to, ok, err := parseIPRange(part); ok {
+		entry.IP2, entry.IP2To = from, to
+		return err
+	}
+	ip, cidr, err := parseCIDR(part)
+	if err != nil {
+		return err
+	}
+	entry.IP2, entry.CIDR2 = ip, cidr
+	return nil
+}
+
+// parseIPRange parses ip-ip, ok is false if s is not a range
+func parseIPRange(s string) (from, to string, ok bool, err error) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return "", "", false, nil
+	}
+	from, to = s[:i], s[i+1:]
+	if net.ParseIP(from) == nil || net.ParseIP(to) == nil {
+		return "", "", true, fmt.Errorf("invalid ip range %s", s)
+	}
+	return from, to, true, nil
+}
+
+// parseCIDR parses ip[/cidr]
+func parseCIDR(s string) (string, *uint8, error) {
+	ip := s
+	var cidr *uint8
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, err := strconv.ParseUint(s[i+1:], 10, 8)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid cidr %s: %v", s, err)
+		}
+		c := uint8(n)
+		ip, cidr = s[:i], &c
+	}
+	if net.ParseIP(ip) == nil {
+		return "", nil, fmt.Errorf("invalid ip %s", s)
+	}
+	return ip, cidr, nil
+}
+
+func parseMacPart(entry *Entry, part string) error {
+	mac, err := net.ParseMAC(part)
+	if err != nil {
+		return err
+	}
+	entry.Mac = mac
+	return nil
+}
+
+// parsePortPart parses [proto:]port[-port], port of icmp and icmpv6 is a type/code name or type/code
+func parsePortPart(entry *Entry, part string) error {
+	proto, port := uint8(unix.IPPROTO_TCP), part
+	if i := strings.IndexByte(part, ':'); i >= 0 {
+		p, err := parseProto(part[:i])
+		if err != nil {
+			return err
+		}
+		proto, port = p, part[i+1:]
+	}
+	entry.Proto = proto
+	var err error
+	switch proto {
+	case unix.IPPROTO_ICMP:
+		entry.Port, err = parseICMP(icmpTypeCodes, port)
+	case unix.IPPROTO_ICMPV6:
+		entry.Port, err = parseICMP(icmpv6TypeCodes, port)
+	default:
+		entry.Port, entry.PortTo, err = parsePortRange(port)
+	}
+	return err
+}
+
+// parseBitmapPortPart parses port[-port]
+func parseBitmapPortPart(entry *Entry, part string) error {
+	var err error
+	entry.Port, entry.PortTo, err = parsePortRange(part)
+	return err
+}
+
+// parseMarkPart parses mark in decimal or hexadecimal with 0x prefix
+func parseMarkPart(entry *Entry, part string) error {
+	mark, err := strconv.ParseUint(part, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mark %s: %v", part, err)
+	}
+	entry.Mark = uint32(mark)
+	return nil
+}
+
+func parseNamePart(entry *Entry, part string) error {
+	entry.Name = part
+	return nil
+}
+
+// parseIfacePart parses [physdev:]iface
+func parseIfacePart(entry *Entry, part string) error {
+	if strings.HasPrefix(part, "physdev:") {
+		entry.PhysDev, part = true, strings.TrimPrefix(part, "physdev:")
+	}
+	if part == "" {
+		return fmt.Errorf("missing iface")
+	}
+	entry.Iface = part
+	return nil
+}
+
+func parseProto(s string) (uint8, error) {
+	if s == "icmpv6" {
+		return unix.IPPROTO_ICMPV6, nil
+	}
+	protocolsOnce.Do(loadProtocols)
+	if proto, ok := protoNumbers[s]; ok {
+		return proto, nil
+	}
+	proto, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %s", s)
+	}
+	return uint8(proto), nil
+}
+
+// parsePortRange parses port[-port], to is 0 if it is a single port
+func parsePortRange(s string) (from, to uint16, err error) {
+	fromStr, toStr := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		fromStr, toStr = s[:i], s[i+1:]
+	}
+	if from, err = parseUint16(fromStr); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s: %v", s, err)
+	}
+	if toStr != "" {
+		if to, err = parseUint16(toStr); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %s: %v", s, err)
+		}
+	}
+	return from, to, nil
+}
+
+// parseICMP parses icmp type/code name or type/code into type<<8|code
+func parseICMP(names []icmpTypeCode, s string) (uint16, error) {
+	for i := range names {
+		if names[i].name == s {
+			return uint16(names[i].typ)<<8 | uint16(names[i].code), nil
+		}
+	}
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid icmp type/code %s", s)
+	}
+	typ, err := strconv.ParseUint(s[:i], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid icmp type/code %s: %v", s, err)
+	}
+	code, err := strconv.ParseUint(s[i+1:], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid icmp type/code %s: %v", s, err)
+	}
+	return uint16(typ)<<8 | uint16(code), nil
+}
+
+// parseSkbMark parses mark[/mask], mask is 0xffffffff if it is omitted
+func parseSkbMark(s string) (mark, mask uint32, err error) {
+	markStr, maskStr := s, ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		markStr, maskStr = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseUint(markStr, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid skbmark %s: %v", s, err)
+	}
+	mark, mask = uint32(n), 0xffffffff
+	if maskStr != "" {
+		n, err := strconv.ParseUint(maskStr, 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid skbmark %s: %v", s, err)
+		}
+		mask = uint32(n)
+	}
+	return mark, mask, nil
+}
+
+// parseSkbPrio parses tc class major:minor in hexadecimal
+func parseSkbPrio(s string) (uint32, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("invalid skbprio %s", s)
+	}
+	major, err := strconv.ParseUint(s[:i], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid skbprio %s: %v", s, err)
+	}
+	minor, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid skbprio %s: %v", s, err)
+	}
+	return uint32(major)<<16 | uint32(minor), nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	return uint16(n), err
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
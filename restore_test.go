@@ -0,0 +1,287 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/ipset/log"
+	"golang.org/x/sys/unix"
+)
+
+func TestSplitLine(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		expect []string
+	}{
+		{line: "", expect: nil},
+		{line: " add  foo\t192.168.0.1 \r", expect: []string{"add", "foo", "192.168.0.1"}},
+		{line: `add foo 192.168.0.1 comment "a b"`, expect: []string{"add", "foo", "192.168.0.1", "comment", `"a b"`}},
+	} {
+		args, err := splitLine(test.line)
+		if err != nil {
+			t.Errorf("case %q: %v", test.line, err)
+			continue
+		}
+		if fmt.Sprintf("%q", args) != fmt.Sprintf("%q", test.expect) {
+			t.Errorf("case %q: expect %q, real %q", test.line, test.expect, args)
+		}
+	}
+	if _, err := splitLine(`add foo 192.168.0.1 comment "a b`); err == nil {
+		t.Error("expect unterminated quote error")
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	cidr24 := uint8(24)
+	timeout := uint32(300)
+	packets, nbytes := uint64(1), uint64(100)
+	for _, test := range []struct {
+		setType SetType
+		elem    string
+		opts    []string
+		expect  Entry
+		// saved is the entry in the format of `ipset save`, empty if it is the same as elem
+		saved string
+	}{
+		{setType: HashIP, elem: "192.168.0.1", expect: Entry{IP: "192.168.0.1"}},
+		{setType: HashNet, elem: "192.168.0.0/24", expect: Entry{IP: "192.168.0.0", CIDR: &cidr24}},
+		{setType: BitmapIPMac, elem: "192.168.0.1", expect: Entry{IP: "192.168.0.1"}},
+		{setType: BitmapIPMac, elem: "192.168.0.1,01:23:45:67:89:AB", expect: Entry{IP: "192.168.0.1", Mac: net.HardwareAddr{1, 0x23, 0x45, 0x67, 0x89, 0xab}}},
+		{setType: HashIPMark, elem: "192.168.0.1,0x00001200", expect: Entry{IP: "192.168.0.1", Mark: 0x1200}},
+		{setType: HashIPMark, elem: "192.168.0.1,10", expect: Entry{IP: "192.168.0.1", Mark: 10}, saved: "192.168.0.1,0x0000000a"},
+		{setType: HashNetIface, elem: "192.168.0.0/24,physdev:eth0", expect: Entry{IP: "192.168.0.0", CIDR: &cidr24, Iface: "eth0", PhysDev: true}},
+		{setType: HashNetIface, elem: "192.168.0.0/24,veth", opts: []string{"wildcard"}, expect: Entry{IP: "192.168.0.0", CIDR: &cidr24, Iface: "veth", Wildcard: true}},
+		{setType: ListSet, elem: "foo", opts: []string{"before", "bar"}, expect: Entry{Name: "foo", NameRef: "bar", Before: true}},
+		{setType: HashNet, elem: "10.1.0.0/24", opts: []string{"nomatch"}, expect: Entry{IP: "10.1.0.0", CIDR: &cidr24, NoMatch: true}},
+		{setType: HashIP, elem: "10.0.0.1", opts: []string{"timeout", "300"}, expect: Entry{IP: "10.0.0.1", Timeout: &timeout}},
+		{setType: HashIP, elem: "10.0.0.1", opts: []string{"packets", "1", "bytes", "100"}, expect: Entry{IP: "10.0.0.1", Packets: &packets, Bytes: &nbytes}},
+		{setType: HashIP, elem: "10.0.0.1", opts: []string{"comment", `"ticket 1"`}, expect: Entry{IP: "10.0.0.1", Comment: "ticket 1"}},
+		{setType: HashIP, elem: "10.0.0.1", opts: []string{"skbmark", "0x10", "skbprio", "1:a", "skbqueue", "3"}, expect: Entry{IP: "10.0.0.1", SkbMark: 0x10, SkbMarkMask: 0xffffffff, SkbPrio: 1<<16 | 10, SkbQueue: 3}},
+		{setType: HashIP, elem: "10.0.0.1", opts: []string{"skbmark", "0x10/0xff"}, expect: Entry{IP: "10.0.0.1", SkbMark: 0x10, SkbMarkMask: 0xff}},
+		{setType: HashIP, elem: "10.0.0.1-10.0.0.5", expect: Entry{IP: "10.0.0.1", IPTo: "10.0.0.5"}},
+		{setType: HashNetNet, elem: "10.0.0.0/24,10.1.0.0-10.1.2.0", expect: Entry{IP: "10.0.0.0", CIDR: &cidr24, IP2: "10.1.0.0", IP2To: "10.1.2.0"}},
+		{setType: HashIPPort, elem: "192.168.0.1,80", expect: Entry{IP: "192.168.0.1", Port: 80, Proto: unix.IPPROTO_TCP}, saved: "192.168.0.1,tcp:80"},
+		{setType: HashIPPort, elem: "192.168.0.1,udp:80-81", expect: Entry{IP: "192.168.0.1", Port: 80, PortTo: 81, Proto: unix.IPPROTO_UDP}, saved: "192.168.0.1,udp:80"},
+		{setType: HashIPPort, elem: "192.168.0.1,icmp:ping", expect: Entry{IP: "192.168.0.1", Port: 8 << 8, Proto: unix.IPPROTO_ICMP}, saved: "192.168.0.1,icmp:echo-request"},
+		{setType: HashIPPort, elem: "192.168.0.1,icmp:3/4", expect: Entry{IP: "192.168.0.1", Port: 3<<8 | 4, Proto: unix.IPPROTO_ICMP}, saved: "192.168.0.1,icmp:fragmentation-needed"},
+		{setType: HashIPPort, elem: "192.168.0.1,icmpv6:1/2", expect: Entry{IP: "192.168.0.1", Port: 1<<8 | 2, Proto: unix.IPPROTO_ICMPV6}, saved: "192.168.0.1,ipv6-icmp:1/2"},
+		{setType: HashIPPort, elem: "192.168.0.1,47:0", expect: Entry{IP: "192.168.0.1", Port: 0, Proto: 47}, saved: "192.168.0.1,gre:0"},
+		{setType: HashIPPort, elem: "192.168.0.1,GRE:0", expect: Entry{IP: "192.168.0.1", Port: 0, Proto: 47}, saved: "192.168.0.1,gre:0"},
+		{setType: HashIPPort, elem: "192.168.0.1,255:0", expect: Entry{IP: "192.168.0.1", Port: 0, Proto: 255}},
+		{setType: HashNetPortNet, elem: "192.168.0.0/24,sctp:80,10.0.0.0/24", expect: Entry{IP: "192.168.0.0", CIDR: &cidr24, Port: 80, Proto: unix.IPPROTO_SCTP, IP2: "10.0.0.0", CIDR2: &cidr24}},
+	} {
+		entry, err := parseEntry(&IPSet{SetType: test.setType}, test.elem, test.opts)
+		if err != nil {
+			t.Errorf("case %s %s: %v", test.setType, test.elem, err)
+			continue
+		}
+		expectJson, err := json.Marshal(test.expect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		realJson, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(expectJson) != string(realJson) {
+			t.Errorf("case %s %s: expect %s, real %s", test.setType, test.elem, expectJson, realJson)
+		}
+		if test.saved == "" {
+			test.saved = test.elem
+		}
+		if str, err := entryString(&IPSet{SetType: test.setType}, entry); err != nil {
+			t.Errorf("case %s %s: %v", test.setType, test.elem, err)
+		} else if str != test.saved {
+			t.Errorf("case %s %s: expect saved as %s, real %s", test.setType, test.elem, test.saved, str)
+		}
+	}
+	for _, test := range []struct {
+		setType SetType
+		elem    string
+	}{
+		{setType: HashIP, elem: "192.168.0.256"},
+		{setType: HashNet, elem: "192.168.0.0/a"},
+		{setType: HashIPPort, elem: "192.168.0.1"},
+		{setType: HashIPPort, elem: "192.168.0.1,foo:80"},
+		{setType: HashIPPort, elem: "192.168.0.1,icmp:foo"},
+		{setType: HashMac, elem: "01:23:45"},
+	} {
+		if _, err := parseEntry(&IPSet{SetType: test.setType}, test.elem, nil); err == nil {
+			t.Errorf("case %s %s: expect error", test.setType, test.elem)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy("TestRestore1")
+	defer h.Destroy("TestRestore2")
+	script := `# comment line
+create TestRestore1 hash:ip family inet hashsize 1024 maxelem 65536
+add TestRestore1 192.168.0.1
+add TestRestore1 192.168.0.2
+add TestRestore1 192.168.0.2 -exist
+del TestRestore1 192.168.0.3 -!
+
+create TestRestore2 hash:ip family inet hashsize 1024 maxelem 65536
+add TestRestore2 192.168.0.3
+create TestRestore2 hash:ip family inet hashsize 1024 maxelem 65536 -exist
+swap TestRestore1 TestRestore2
+rename TestRestore1 TestRestore3
+add TestRestore3 192.168.0.4
+rename TestRestore3 TestRestore1
+`
+	if err := h.Restore(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := h.Save(&buf, "TestRestore1", "TestRestore2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"create TestRestore1 hash:ip family inet hashsize 1024 maxelem 65536",
+		"add TestRestore1 192.168.0.3\n",
+		"add TestRestore1 192.168.0.4\n",
+		"create TestRestore2 hash:ip family inet hashsize 1024 maxelem 65536",
+		"add TestRestore2 192.168.0.1\n",
+		"add TestRestore2 192.168.0.2\n",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expect %q in save output %q", expect, buf.String())
+		}
+	}
+	// restoring the saved output again with -exist doesn't change anything
+	saved := buf.String()
+	if err := h.Restore(strings.NewReader(saved), IPSET_OPT_EXIST); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := h.Save(&buf, "TestRestore1", "TestRestore2"); err != nil {
+		t.Fatal(err)
+	}
+	if sortedLines(buf.String()) != sortedLines(saved) {
+		t.Errorf("expect save output %q, real %q", saved, buf.String())
+	}
+	err = h.Restore(strings.NewReader("flush TestRestore1\nadd TestRestore2 192.168.0.1\n"))
+	if err == nil || err.Error() != "line 2: element already exists" {
+		t.Errorf("expect line 2 element already exists error, real %v", err)
+	}
+	err = h.Restore(strings.NewReader("del TestRestore1 192.168.0.1\n"))
+	if err == nil || err.Error() != "line 1: element does not exist" {
+		t.Errorf("expect line 1 element does not exist error, real %v", err)
+	}
+	if err := checkEntryNum(h, "TestRestore1", 0); err != nil {
+		t.Error(err)
+	}
+	if err := h.Restore(strings.NewReader("destroy TestRestore1\n\ndestroy TestRestore2\nfoo\n")); err == nil || err.Error() != "line 4: unknown command foo" {
+		t.Errorf("expect unknown command error, real %v", err)
+	}
+}
+
+// sortedLines sorts lines of s as entries of hash sets are listed in random order
+func sortedLines(s string) string {
+	lines := strings.Split(s, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestRestoreForceAdd(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "TestRestoreForceAdd"
+	if err := h.Create(&IPSet{Name: name, SetType: HashIP, WithForceAdd: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(name)
+	saved, err := checkSaveRestore(h, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(saved, " forceadd") {
+		t.Errorf("expect forceadd in save output %q", saved)
+	}
+	header, err := h.Header(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.WithForceAdd {
+		t.Errorf("expect forceadd set, real %+v", header.IPSet)
+	}
+}
+
+func TestRestoreListSet(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"TestRestoreListSetA", "TestRestoreListSetB", "TestRestoreListSet"}
+	script := `create TestRestoreListSetA hash:ip family inet hashsize 1024 maxelem 65536
+create TestRestoreListSetB hash:ip family inet hashsize 1024 maxelem 65536
+create TestRestoreListSet list:set size 4
+add TestRestoreListSet TestRestoreListSetB
+add TestRestoreListSet TestRestoreListSetA before TestRestoreListSetB
+`
+	if err := h.Restore(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	defer destroySets(h, names)
+	header, err := h.Header("TestRestoreListSet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Size != 4 {
+		t.Errorf("expect size 4, real %+v", header.IPSet)
+	}
+	saved, err := checkSaveRestore(h, names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(saved, "create TestRestoreListSet list:set size 4\n"+
+		"add TestRestoreListSet TestRestoreListSetA\nadd TestRestoreListSet TestRestoreListSetB\n") {
+		t.Errorf("unexpected save output %q", saved)
+	}
+}
+
+// checkSaveRestore saves the sets, destroys them, restores the saved output and checks that saving them again
+// produces the same output. It returns the saved output.
+func checkSaveRestore(h *Handle, names ...string) (string, error) {
+	var buf bytes.Buffer
+	if err := h.Save(&buf, names...); err != nil {
+		return "", err
+	}
+	saved := buf.String()
+	if err := destroySets(h, names); err != nil {
+		return "", err
+	}
+	if err := h.Restore(strings.NewReader(saved)); err != nil {
+		return "", fmt.Errorf("failed to restore %q: %v", saved, err)
+	}
+	buf.Reset()
+	if err := h.Save(&buf, names...); err != nil {
+		return "", err
+	}
+	if sortedLines(buf.String()) != sortedLines(saved) {
+		return "", fmt.Errorf("expect save output %q, real %q", saved, buf.String())
+	}
+	return saved, nil
+}
+
+// destroySets destroys sets in the reverse order so that list:set sets are destroyed before their members
+func destroySets(h *Handle, names []string) error {
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := h.Destroy(names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package ipset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Save writes the specified sets, or all sets if no names given, to w in the format of `ipset save`
+func (h *Handle) Save(w io.Writer, names ...string) error {
+	var sets []ListItem
+	if len(names) == 0 {
+		all, err := h.dump(IPSET_CMD_SAVE, "", 0)
+		if err != nil {
+			return err
+		}
+		sets = all
+	}
+	for _, name := range names {
+		if err := checkSetName("save", name); err != nil {
+			return err
+		}
+		items, err := h.dump(IPSET_CMD_SAVE, name, 0)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, items...)
+	}
+	bw := bufio.NewWriter(w)
+	for i := range sets {
+		if err := writeSet(bw, &sets[i]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSet(w io.Writer, set *ListItem) error {
+	line := fmt.Sprintf("create %s %s", set.Name, set.SetType)
+	for _, opt := range createOptions(set) {
+		line += " " + opt
+	}
+	if _, err := fmt.Fprintln(w, line); err != nil {
+		return err
+	}
+	for i := range set.Entries {
+		entry, err := entryString(&set.IPSet, &set.Entries[i])
+		if err != nil {
+			return err
+		}
+		for _, opt := range entryOptions(&set.Entries[i]) {
+			entry += " " + opt
+		}
+		if _, err := fmt.Fprintf(w, "add %s %s\n", set.Name, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createOptions returns the create options of set in the order of `ipset save`
+func createOptions(set *ListItem) []string {
+	var opts []string
+	if isHashType(set.SetType) && set.Family != "" {
+		opts = append(opts, "family "+set.Family)
+	}
+	if set.IPRange != "" {
+		opts = append(opts, "range "+set.IPRange)
+	}
+	if set.PortRange != "" {
+		opts = append(opts, "range "+set.PortRange)
+	}
+	if !isHashType(set.SetType) && set.Netmask != 0 {
+		opts = append(opts, "netmask "+strconv.Itoa(int(set.Netmask)))
+	}
+	if set.MarkMask != 0 {
+		opts = append(opts, fmt.Sprintf("markmask 0x%08x", set.MarkMask))
+	}
+	if set.HashSize != 0 {
+		opts = append(opts, "hashsize "+strconv.Itoa(set.HashSize))
+	}
+	if set.MaxElem != 0 {
+		opts = append(opts, "maxelem "+strconv.Itoa(set.MaxElem))
+	}
+	if isHashType(set.SetType) && set.Netmask != 0 {
+		opts = append(opts, "netmask "+strconv.Itoa(int(set.Netmask)))
+	}
+	if set.Size != 0 {
+		opts = append(opts, "size "+strconv.FormatUint(uint64(set.Size), 10))
+	}
+	if set.Timeout != nil {
+		opts = append(opts, "timeout "+strconv.FormatUint(uint64(*set.Timeout), 10))
+	}
+	if set.WithCounters {
+		opts = append(opts, "counters")
+	}
+	if set.WithComment {
+		opts = append(opts, "comment")
+	}
+	if set.WithForceAdd {
+		opts = append(opts, "forceadd")
+	}
+	if set.WithSkbInfo {
+		opts = append(opts, "skbinfo")
+	}
+	if set.Probes != 0 {
+		opts = append(opts, "probes "+strconv.Itoa(int(set.Probes)))
+	}
+	if set.Resize != 0 {
+		opts = append(opts, "resize "+strconv.Itoa(int(set.Resize)))
+	}
+	if set.BucketSize != 0 {
+		opts = append(opts, "bucketsize "+strconv.Itoa(int(set.BucketSize)))
+	}
+	if set.InitVal != nil {
+		opts = append(opts, fmt.Sprintf("initval 0x%08x", *set.InitVal))
+	}
+	return opts
+}
+
+// entryOptions returns the options of entry in the order of `ipset save`
+func entryOptions(entry *Entry) []string {
+	var opts []string
+	if entry.Timeout != nil {
+		opts = append(opts, "timeout "+strconv.FormatUint(uint64(*entry.Timeout), 10))
+	}
+	if entry.NoMatch {
+		opts = append(opts, "nomatch")
+	}
+	if entry.Packets != nil {
+		opts = append(opts, "packets "+strconv.FormatUint(*entry.Packets, 10))
+	}
+	if entry.Bytes != nil {
+		opts = append(opts, "bytes "+strconv.FormatUint(*entry.Bytes, 10))
+	}
+	if entry.Comment != "" {
+		opts = append(opts, `comment "`+entry.Comment+`"`)
+	}
+	if entry.SkbMark != 0 || entry.SkbMarkMask != 0 {
+		if entry.SkbMarkMask == 0xffffffff {
+			opts = append(opts, fmt.Sprintf("skbmark 0x%x", entry.SkbMark))
+		} else {
+			opts = append(opts, fmt.Sprintf("skbmark 0x%x/0x%x", entry.SkbMark, entry.SkbMarkMask))
+		}
+	}
+	if entry.SkbPrio != 0 {
+		opts = append(opts, fmt.Sprintf("skbprio %x:%x", entry.SkbPrio>>16, entry.SkbPrio&0xffff))
+	}
+	if entry.SkbQueue != 0 {
+		opts = append(opts, "skbqueue "+strconv.Itoa(int(entry.SkbQueue)))
+	}
+	if entry.NameRef != "" {
+		if entry.Before {
+			opts = append(opts, "before "+entry.NameRef)
+		} else {
+			opts = append(opts, "after "+entry.NameRef)
+		}
+	}
+	if entry.Wildcard {
+		opts = append(opts, "wildcard")
+	}
+	return opts
+}
+
+type formatEntryFunc func(entry *Entry) string
+
+var setTypeFormatFuncMap = map[SetType][]formatEntryFunc{
+	HashIP:         {formatIP},
+	BitmapIP:       {formatIP},
+	BitmapIPMac:    {formatIP, formatOptionalMac},
+	BitmapPort:     {formatBitmapPort},
+	HashMac:        {formatMac},
+	HashIPMac:      {formatIP, formatMac},
+	HashNet:        {formatIP},
+	HashNetNet:     {formatIP, formatIP2},
+	HashIPPort:     {formatIP, formatPort},
+	HashNetPort:    {formatIP, formatPort},
+	HashIPPortIP:   {formatIP, formatPort, formatIP2},
+	HashIPPortNet:  {formatIP, formatPort, formatIP2},
+	HashNetPortNet: {formatIP, formatPort, formatIP2},
+	HashIPMark:     {formatIP, formatMark},
+	HashNetIface:   {formatIP, formatIface},
+	ListSet:        {formatName},
+}
+
+// entryString returns entry in the format of `ipset save`, e.g. 192.168.0.1,tcp:80
+func entryString(set *IPSet, entry *Entry) (string, error) {
+	funcs, exist := setTypeFormatFuncMap[set.SetType]
+	if !exist {
+		return "", fmt.Errorf("saving entries for setType %s not supported now", set.SetType)
+	}
+	var parts []string
+	for i := range funcs {
+		// optional parts which are not set are formatted as empty strings
+		if part := funcs[i](entry); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
+
+func formatIP(entry *Entry) string {
+	if entry.IPTo != "" {
+		return entry.IP + "-" + entry.IPTo
+	}
+	return formatCIDR(entry.IP, entry.CIDR)
+}
+
+func formatIP2(entry *Entry) string {
+	if entry.IP2To != "" {
+		return entry.IP2 + "-" + entry.IP2To
+	}
+	return formatCIDR(entry.IP2, entry.CIDR2)
+}
+
+// formatCIDR omits the host prefix length as `ipset save` does
+func formatCIDR(ip string, cidr *uint8) string {
+	if cidr == nil {
+		return ip
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if (parsed.To4() != nil && *cidr == 32) || (parsed.To4() == nil && *cidr == 128) {
+			return ip
+		}
+	}
+	return ip + "/" + strconv.Itoa(int(*cidr))
+}
+
+func formatMac(entry *Entry) string {
+	return strings.ToUpper(entry.Mac.String())
+}
+
+func formatOptionalMac(entry *Entry) string {
+	if len(entry.Mac) == 0 {
+		return ""
+	}
+	return formatMac(entry)
+}
+
+func formatPort(entry *Entry) string {
+	switch entry.Proto {
+	case unix.IPPROTO_ICMP:
+		return protoName(entry.Proto) + ":" + icmpString(icmpTypeCodes, entry.Port)
+	case unix.IPPROTO_ICMPV6:
+		return protoName(entry.Proto) + ":" + icmpString(icmpv6TypeCodes, entry.Port)
+	default:
+		return protoName(entry.Proto) + ":" + strconv.Itoa(int(entry.Port))
+	}
+}
+
+func formatBitmapPort(entry *Entry) string {
+	return strconv.Itoa(int(entry.Port))
+}
+
+func formatMark(entry *Entry) string {
+	return fmt.Sprintf("0x%08x", entry.Mark)
+}
+
+func formatName(entry *Entry) string {
+	return entry.Name
+}
+
+func formatIface(entry *Entry) string {
+	if entry.PhysDev {
+		return "physdev:" + entry.Iface
+	}
+	return entry.Iface
+}
+
+// protocolsFile is the protocol database which protocol names are resolved with like getprotobynumber(3) and
+// getprotobyname(3)
+const protocolsFile = "/etc/protocols"
+
+// defaultProtoNames are used if protocolsFile does not exist or lacks them
+var defaultProtoNames = map[uint8]string{
+	unix.IPPROTO_ICMP:    "icmp",
+	unix.IPPROTO_TCP:     "tcp",
+	unix.IPPROTO_UDP:     "udp",
+	unix.IPPROTO_ICMPV6:  "ipv6-icmp",
+	unix.IPPROTO_SCTP:    "sctp",
+	unix.IPPROTO_UDPLITE: "udplite",
+}
+
+var (
+	protocolsOnce sync.Once
+	// protoNames maps protocol numbers to official names, protoNumbers maps official names and aliases to numbers
+	protoNames   map[uint8]string
+	protoNumbers map[string]uint8
+)
+
+func loadProtocols() {
+	protoNames, protoNumbers = map[uint8]string{}, map[string]uint8{}
+	if f, err := os.Open(protocolsFile); err == nil {
+		protoNames, protoNumbers = parseProtocols(f)
+		f.Close()
+	}
+	for proto, name := range defaultProtoNames {
+		if _, ok := protoNames[proto]; !ok {
+			protoNames[proto] = name
+		}
+		if _, ok := protoNumbers[name]; !ok {
+			protoNumbers[name] = proto
+		}
+	}
+}
+
+// parseProtocols parses lines of "name number [aliases...] [# comment]" in the format of /etc/protocols. The first
+// name of a number wins.
+func parseProtocols(r io.Reader) (map[uint8]string, map[string]uint8) {
+	names, numbers := map[uint8]string{}, map[string]uint8{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		proto, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[uint8(proto)]; !ok {
+			names[uint8(proto)] = fields[0]
+		}
+		for _, name := range append(fields[:1:1], fields[2:]...) {
+			if _, ok := numbers[name]; !ok {
+				numbers[name] = uint8(proto)
+			}
+		}
+	}
+	return names, numbers
+}
+
+// protoName returns the name of proto, or the number if it has no name
+func protoName(proto uint8) string {
+	protocolsOnce.Do(loadProtocols)
+	if name, ok := protoNames[proto]; ok {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
+
+type icmpTypeCode struct {
+	name      string
+	typ, code uint8
+}
+
+// icmpTypeCodes is copied from ipset/lib/icmp.c, the first name of a type/code is used when saving
+var icmpTypeCodes = []icmpTypeCode{
+	{"echo-reply", 0, 0},
+	{"pong", 0, 0},
+	{"network-unreachable", 3, 0},
+	{"host-unreachable", 3, 1},
+	{"protocol-unreachable", 3, 2},
+	{"port-unreachable", 3, 3},
+	{"fragmentation-needed", 3, 4},
+	{"source-route-failed", 3, 5},
+	{"network-unknown", 3, 6},
+	{"host-unknown", 3, 7},
+	{"network-prohibited", 3, 9},
+	{"host-prohibited", 3, 10},
+	{"TOS-network-unreachable", 3, 11},
+	{"TOS-host-unreachable", 3, 12},
+	{"communication-prohibited", 3, 13},
+	{"host-precedence-violation", 3, 14},
+	{"precedence-cutoff", 3, 15},
+	{"source-quench", 4, 0},
+	{"network-redirect", 5, 0},
+	{"host-redirect", 5, 1},
+	{"TOS-network-redirect", 5, 2},
+	{"TOS-host-redirect", 5, 3},
+	{"echo-request", 8, 0},
+	{"ping", 8, 0},
+	{"router-advertisement", 9, 0},
+	{"router-solicitation", 10, 0},
+	{"ttl-zero-during-transit", 11, 0},
+	{"ttl-zero-during-reassembly", 11, 1},
+	{"ip-header-bad", 12, 0},
+	{"required-option-missing", 12, 1},
+	{"timestamp-request", 13, 0},
+	{"timestamp-reply", 14, 0},
+	{"address-mask-request", 17, 0},
+	{"address-mask-reply", 18, 0},
+}
+
+// icmpv6TypeCodes is copied from ipset/lib/icmpv6.c
+var icmpv6TypeCodes = []icmpTypeCode{
+	{"no-route", 1, 0},
+	{"communication-prohibited", 1, 1},
+	{"address-unreachable", 1, 3},
+	{"port-unreachable", 1, 4},
+	{"packet-too-big", 2, 0},
+	{"ttl-zero-during-transit", 3, 0},
+	{"ttl-zero-during-reassembly", 3, 1},
+	{"bad-header", 4, 0},
+	{"unknown-header-type", 4, 1},
+	{"unknown-option", 4, 2},
+	{"echo-request", 128, 0},
+	{"ping", 128, 0},
+	{"echo-reply", 129, 0},
+	{"pong", 129, 0},
+	{"router-solicitation", 133, 0},
+	{"router-advertisement", 134, 0},
+	{"neighbour-solicitation", 135, 0},
+	{"neigbour-solicitation", 135, 0},
+	{"neighbour-advertisement", 136, 0},
+	{"neigbour-advertisement", 136, 0},
+	{"redirect", 137, 0},
+}
+
+// icmpString returns the name of icmp type/code stored in port as type<<8|code, or type/code if it has no name
+func icmpString(names []icmpTypeCode, port uint16) string {
+	typ, code := uint8(port>>8), uint8(port)
+	for i := range names {
+		if names[i].typ == typ && names[i].code == code {
+			return names[i].name
+		}
+	}
+	return fmt.Sprintf("%d/%d", typ, code)
+}
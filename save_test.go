@@ -0,0 +1,174 @@
+package ipset
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chenchun/ipset/log"
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteSet(t *testing.T) {
+	mac, err := net.ParseMAC("01:23:45:67:89:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr24, cidr25, cidr32 := uint8(24), uint8(25), uint8(32)
+	timeout, initVal := uint32(300), uint32(0xabcd)
+	for _, test := range []struct {
+		set    *ListItem
+		expect string
+	}{
+		{
+			set: &ListItem{
+				IPSet: IPSet{Name: "foo", SetType: HashIP, Family: "inet", HashSize: 1024, MaxElem: 65536, Timeout: &timeout,
+					WithCounters: true, WithComment: true},
+				Entries: []Entry{{IP: "192.168.0.1"}, {IP: "192.168.0.2", Comment: "ticket 1"}},
+			},
+			expect: "create foo hash:ip family inet hashsize 1024 maxelem 65536 timeout 300 counters comment\n" +
+				"add foo 192.168.0.1\nadd foo 192.168.0.2 comment \"ticket 1\"\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: HashMac, HashSize: 1024, MaxElem: 65536},
+				Entries: []Entry{{Mac: mac}},
+			},
+			expect: "create foo hash:mac hashsize 1024 maxelem 65536\nadd foo 01:23:45:67:89:AB\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: HashNet, Family: "inet", HashSize: 1024, MaxElem: 65536},
+				Entries: []Entry{{IP: "192.168.0.0", CIDR: &cidr24}, {IP: "192.168.1.1", CIDR: &cidr32}, {IP: "192.168.0.128", CIDR: &cidr25, NoMatch: true}},
+			},
+			expect: "create foo hash:net family inet hashsize 1024 maxelem 65536\nadd foo 192.168.0.0/24\nadd foo 192.168.1.1\n" +
+				"add foo 192.168.0.128/25 nomatch\n",
+		},
+		{
+			set: &ListItem{
+				IPSet: IPSet{Name: "foo", SetType: HashIPPortNet, Family: "inet", HashSize: 1024, MaxElem: 65536},
+				Entries: []Entry{
+					{IP: "192.168.0.1", Port: 80, Proto: unix.IPPROTO_TCP, IP2: "10.0.0.0", CIDR2: &cidr24},
+					{IP: "192.168.0.1", Port: 8 << 8, Proto: unix.IPPROTO_ICMP, IP2: "10.0.0.0", CIDR2: &cidr24},
+					{IP: "192.168.0.1", Port: 0, Proto: 47, IP2: "10.0.0.0", CIDR2: &cidr24},
+				},
+			},
+			expect: "create foo hash:ip,port,net family inet hashsize 1024 maxelem 65536\n" +
+				"add foo 192.168.0.1,tcp:80,10.0.0.0/24\nadd foo 192.168.0.1,icmp:echo-request,10.0.0.0/24\nadd foo 192.168.0.1,gre:0,10.0.0.0/24\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: BitmapIP, Family: "inet", IPRange: "10.0.0.0-10.0.255.255", Netmask: 24},
+				Entries: []Entry{{IP: "10.0.1.0"}},
+			},
+			expect: "create foo bitmap:ip range 10.0.0.0-10.0.255.255 netmask 24\nadd foo 10.0.1.0\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: BitmapPort, PortRange: "0-1024"},
+				Entries: []Entry{{Port: 22}, {Port: 80}},
+			},
+			expect: "create foo bitmap:port range 0-1024\nadd foo 22\nadd foo 80\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: HashIPMark, Family: "inet", MarkMask: 0xff00, HashSize: 1024, MaxElem: 65536},
+				Entries: []Entry{{IP: "192.168.0.1", Mark: 0x1200}},
+			},
+			expect: "create foo hash:ip,mark family inet markmask 0x0000ff00 hashsize 1024 maxelem 65536\nadd foo 192.168.0.1,0x00001200\n",
+		},
+		{
+			set: &ListItem{
+				IPSet: IPSet{Name: "foo", SetType: HashNetIface, Family: "inet", HashSize: 1024, MaxElem: 65536},
+				Entries: []Entry{
+					{IP: "192.168.0.0", CIDR: &cidr24, Iface: "eth0", PhysDev: true},
+					{IP: "192.168.1.0", CIDR: &cidr24, Iface: "veth", Wildcard: true},
+				},
+			},
+			expect: "create foo hash:net,iface family inet hashsize 1024 maxelem 65536\n" +
+				"add foo 192.168.0.0/24,physdev:eth0\nadd foo 192.168.1.0/24,veth wildcard\n",
+		},
+		{
+			set: &ListItem{
+				IPSet:   IPSet{Name: "foo", SetType: ListSet, Size: 8},
+				Entries: []Entry{{Name: "a"}, {Name: "b", NameRef: "a"}, {Name: "c", NameRef: "a", Before: true}},
+			},
+			expect: "create foo list:set size 8\nadd foo a\nadd foo b after a\nadd foo c before a\n",
+		},
+		{
+			set: &ListItem{
+				IPSet: IPSet{Name: "foo", SetType: HashIP, Family: "inet", HashSize: 1024, MaxElem: 65536, Netmask: 24,
+					BucketSize: 12, InitVal: &initVal},
+			},
+			expect: "create foo hash:ip family inet hashsize 1024 maxelem 65536 netmask 24 bucketsize 12 initval 0x0000abcd\n",
+		},
+		{
+			set: &ListItem{
+				IPSet: IPSet{Name: "foo", SetType: HashIP, Family: "inet", HashSize: 1024, MaxElem: 65536, WithSkbInfo: true},
+				Entries: []Entry{
+					{IP: "192.168.0.1", SkbMark: 0x10, SkbMarkMask: 0xffffffff},
+					{IP: "192.168.0.2", SkbMark: 0x20, SkbMarkMask: 0xff, SkbPrio: 1<<16 | 10, SkbQueue: 3},
+				},
+			},
+			expect: "create foo hash:ip family inet hashsize 1024 maxelem 65536 skbinfo\n" +
+				"add foo 192.168.0.1 skbmark 0x10\nadd foo 192.168.0.2 skbmark 0x20/0xff skbprio 1:a skbqueue 3\n",
+		},
+	} {
+		var buf bytes.Buffer
+		if err := writeSet(&buf, test.set); err != nil {
+			t.Errorf("case %s: %v", test.set.SetType, err)
+			continue
+		}
+		if buf.String() != test.expect {
+			t.Errorf("case %s: expect %q, real %q", test.set.SetType, test.expect, buf.String())
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	h, err := New(&log.Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &IPSet{Name: "TestSave", SetType: HashIPPort}
+	if err := h.Create(set); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Destroy(set.Name)
+	if err := h.Add(set, &Entry{IP: "192.168.0.1", Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := h.Save(&buf, set.Name); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "create TestSave hash:ip,port family inet hashsize 1024 maxelem 65536") ||
+		lines[1] != "add TestSave 192.168.0.1,tcp:80" {
+		t.Errorf("unexpected save output %q", buf.String())
+	}
+	buf.Reset()
+	if err := h.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "add TestSave 192.168.0.1,tcp:80\n") {
+		t.Errorf("expect set %s in save output %q", set.Name, buf.String())
+	}
+}
+
+func TestParseProtocols(t *testing.T) {
+	names, numbers := parseProtocols(strings.NewReader(`# Internet (IP) protocols
+ip	0	IP		# internet protocol, pseudo protocol number
+hopopt	0	HOPOPT		# IPv6 Hop-by-Hop Option [RFC1883]
+gre	47	GRE		# General Routing Encapsulation
+invalid	256
+`))
+	if !reflect.DeepEqual(names, map[uint8]string{0: "ip", 47: "gre"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+	if !reflect.DeepEqual(numbers, map[string]uint8{"ip": 0, "IP": 0, "hopopt": 0, "HOPOPT": 0, "gre": 47, "GRE": 47}) {
+		t.Errorf("unexpected numbers %v", numbers)
+	}
+}